@@ -1,8 +1,12 @@
 package sheriff
 
 import (
+	"bytes"
 	"encoding/json"
+	"reflect"
 	"testing"
+
+	version "github.com/hashicorp/go-version"
 )
 
 type SubModel struct {
@@ -112,3 +116,114 @@ func BenchmarkModelsMarshaller_Marshal(b *testing.B) {
 		}
 	}
 }
+
+type TaggedBenchmarkModel struct {
+	AString string   `json:"a_string" groups:"api,detail" since:"1.0.0"`
+	AInt    int      `json:"a_int" groups:"api" until:"3.0.0"`
+	ABool   bool     `json:"a_bool" groups:"detail,!public"`
+	AArray  []string `json:"a_array,omitempty" groups:"api" since:"1.1.0" until:"2.0.0"`
+
+	BString string   `json:"b_string" groups:"api,detail" since:"1.0.0"`
+	BInt    int      `json:"b_int" groups:"api" until:"3.0.0"`
+	BBool   bool     `json:"b_bool" groups:"detail,!public"`
+	BArray  []string `json:"b_array,omitempty" groups:"api" since:"1.1.0" until:"2.0.0"`
+}
+
+func BenchmarkModelsMarshaller_Marshal_Tagged(b *testing.B) {
+	s := make([]TaggedBenchmarkModel, 100)
+	for i := range s {
+		s[i] = TaggedBenchmarkModel{
+			AString: "str", AInt: 1123, ABool: true, AArray: []string{"a", "b", "c"},
+			BString: "str", BInt: 1123, BBool: true, BArray: []string{"a", "b", "c"},
+		}
+	}
+	v, err := version.NewVersion("1.5.0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	o := &Options{Groups: []string{"api", "detail"}, ApiVersion: v}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := Marshal(o, s)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkModelsMarshaller_Marshal_Untagged compares marshalling fields without sheriff tags with and without
+// skipping the evaluation of their groups and versions. An empty group override marks a field as tagged without
+// changing the output, so both variants pay for looking up the overrides.
+func BenchmarkModelsMarshaller_Marshal_Untagged(b *testing.B) {
+	s := make([]BenchmarkModel, 100)
+	for i := range s {
+		s[i] = *testData()
+	}
+	v, err := version.NewVersion("1.5.0")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	expected, err := Marshal(&Options{}, s[0])
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	skipped := map[string][]string{"Unknown.Field": {}}
+	evaluated := make(map[string][]string)
+	for _, t := range []reflect.Type{reflect.TypeOf(BenchmarkModel{}), reflect.TypeOf(SubModel{})} {
+		for i := 0; i < t.NumField(); i++ {
+			evaluated[t.Name()+"."+t.Field(i).Name] = []string{}
+		}
+	}
+
+	for _, bm := range []struct {
+		name      string
+		overrides map[string][]string
+	}{
+		{"Skipped", skipped},
+		{"Evaluated", evaluated},
+	} {
+		o := &Options{Groups: []string{"api", "detail"}, ApiVersion: v, OutputFieldsWithNoGroup: true, FieldGroupOverrides: bm.overrides}
+		if d, err := Marshal(o, s[:1]); err != nil || !reflect.DeepEqual(d, []interface{}{expected}) {
+			b.Fatalf("unexpected output %v: %v", d, err)
+		}
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := Marshal(o, s)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkModelsMarshaller_MarshalJSON(b *testing.B) {
+	s := testData()
+	o := &Options{}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := MarshalJSON(o, s)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkModelsMarshaller_Encoder(b *testing.B) {
+	s := testData()
+	o := &Options{}
+	var buf bytes.Buffer
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		err := NewEncoder(&buf, o).Encode(s)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package sheriff
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"reflect"
+)
+
+// An Encoder writes the JSON encoding of marshalled data to an io.Writer.
+//
+// Unlike StreamMarshaller, structs as well as slices and arrays are written field by field and element
+// by element, so neither the top-level value nor its elements are held in memory as a whole.
+// The fields of a struct are written in the order of their declaration.
+type Encoder struct {
+	w       io.Writer
+	options *Options
+}
+
+// NewEncoder returns an Encoder writing to w using the given options.
+func NewEncoder(w io.Writer, options *Options) *Encoder {
+	return &Encoder{w: w, options: options}
+}
+
+// Encode writes the JSON encoding of data, followed by a newline character, to the underlying writer.
+func (e *Encoder) Encode(data interface{}) error {
+	options, err := resolveOptions(e.options)
+	if err != nil {
+		return err
+	}
+	if err := checkRequireStruct(options, data); err != nil {
+		return err
+	}
+	e = &Encoder{w: e.w, options: options}
+	groups := make(groupSet)
+	groups.incrementGroups(e.options.Groups)
+	parents := make(groupSet)
+	visited := make(pointerSet)
+	path := &fieldPath{}
+
+	if err := e.encodeValue(context.Background(), reflect.ValueOf(data), groups, parents, visited, path, 0); err != nil {
+		return err
+	}
+	_, err = io.WriteString(e.w, "\n")
+	return err
+}
+
+func (e *Encoder) encodeValue(ctx context.Context, v reflect.Value, groups, parents groupSet, visited pointerSet, path *fieldPath, depth int) error {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if !v.IsValid() || !v.CanInterface() {
+		return e.write(nil)
+	}
+	if marshalledBySelf(v.Interface()) || marshalledByJSON(e.options, v.Interface()) {
+		return e.encodeMarshalled(ctx, v, groups, parents, visited, path, depth)
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return e.write(nil)
+		}
+		if visited.contains(v) {
+			return e.encodeMarshalled(ctx, v, groups, parents, visited, path, depth)
+		}
+		visited.add(v)
+		defer visited.remove(v)
+		return e.encodeValue(ctx, v.Elem(), groups, parents, visited, path, depth)
+	case reflect.Struct:
+		return e.encodeStruct(ctx, v, groups, parents, visited, path, depth)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return e.write(nil)
+		}
+		return e.encodeSlice(ctx, v, groups, parents, visited, path, depth)
+	}
+	return e.encodeMarshalled(ctx, v, groups, parents, visited, path, depth)
+}
+
+func (e *Encoder) encodeStruct(ctx context.Context, v reflect.Value, groups, parents groupSet, visited pointerSet, path *fieldPath, depth int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := checkDepth(e.options, depth); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(e.w, "{"); err != nil {
+		return err
+	}
+	first := true
+	err := marshalFields(ctx, e.options, v, groups, parents, visited, path, depth+1, false, func(name string, value interface{}) error {
+		if !first {
+			if _, err := io.WriteString(e.w, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+		if err := e.write(name); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(e.w, ":"); err != nil {
+			return err
+		}
+		return e.write(value)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(e.w, "}")
+	return err
+}
+
+func (e *Encoder) encodeSlice(ctx context.Context, v reflect.Value, groups, parents groupSet, visited pointerSet, path *fieldPath, depth int) error {
+	if err := checkDepth(e.options, depth); err != nil {
+		return err
+	}
+	if e.options.FlattenSingleElementSlices && v.Len() == 1 && depth > 0 {
+		path.pushIndex(0)
+		defer path.pop()
+		return e.encodeValue(ctx, v.Index(0), groups, parents, visited, path, depth+1)
+	}
+	if _, err := io.WriteString(e.w, "["); err != nil {
+		return err
+	}
+	for i := 0; i < v.Len(); i++ {
+		if i > 0 {
+			if _, err := io.WriteString(e.w, ","); err != nil {
+				return err
+			}
+		}
+		path.pushIndex(i)
+		if err := e.encodeValue(ctx, v.Index(i), groups, parents, visited, path, depth+1); err != nil {
+			return err
+		}
+		path.pop()
+	}
+	_, err := io.WriteString(e.w, "]")
+	return err
+}
+
+// encodeMarshalled writes values which aren't streamed using marshalValue.
+func (e *Encoder) encodeMarshalled(ctx context.Context, v reflect.Value, groups, parents groupSet, visited pointerSet, path *fieldPath, depth int) error {
+	d, err := marshalValue(ctx, e.options, v, groups, parents, visited, path, depth, false)
+	if err != nil {
+		return err
+	}
+	return e.write(d)
+}
+
+func (e *Encoder) write(value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(b)
+	return err
+}
@@ -0,0 +1,75 @@
+package sheriff
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func assertEncodeEqualsMarshalJSON(t *testing.T, options *Options, data interface{}) {
+	expected, err := MarshalJSON(options, data)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, NewEncoder(&buf, options).Encode(data))
+	assert.JSONEq(t, string(expected), buf.String())
+}
+
+func TestEncoder_Encode(t *testing.T) {
+	model := &TestGroupsModel{
+		DefaultMarshal:     "DefaultMarshal",
+		OnlyGroupTest:      "OnlyGroupTest",
+		OnlyGroupTestOther: "OnlyGroupTestOther",
+		SliceString:        []string{"test", "bla"},
+		MapStringStruct:    map[string]AModel{"firstModel": {true, true}},
+	}
+	o := &Options{Groups: []string{"test"}}
+
+	assertEncodeEqualsMarshalJSON(t, o, model)
+	assertEncodeEqualsMarshalJSON(t, o, []*TestGroupsModel{model, nil, model})
+	assertEncodeEqualsMarshalJSON(t, o, []interface{}{model, nil, 1})
+	assertEncodeEqualsMarshalJSON(t, o, [1]TestGroupsModel{*model})
+	assertEncodeEqualsMarshalJSON(t, o, []TestGroupsModel(nil))
+	assertEncodeEqualsMarshalJSON(t, o, TestRecursiveModel{SomeData: "SomeData", GroupsData: []*TestGroupsModel{model}})
+	assertEncodeEqualsMarshalJSON(t, o, TestMarshal_EmbeddedParent{&TestMarshal_Embedded{"Hello"}, "World"})
+	assertEncodeEqualsMarshalJSON(t, o, "string")
+
+	var buf bytes.Buffer
+	assert.NoError(t, NewEncoder(&buf, &Options{}).Encode(TestVersionsModel{DefaultMarshal: "a", Until20: "b"}))
+	assert.Equal(t, `{"default_marshal":"a","until_20":"b","until_21":"","since_20":"","since_21":""}`+"\n", buf.String())
+}
+
+func TestEncoder_EncodeExposedFields(t *testing.T) {
+	v := &TestExposedFieldsModel{Name: "name", Override: "override", secret: "secret"}
+
+	// overridden fields are only written once
+	var buf bytes.Buffer
+	assert.NoError(t, NewEncoder(&buf, &Options{Groups: []string{"api"}}).Encode(v))
+	assert.Equal(t, `{"name":"name","child":{"public":""},"override":"overridden","secret":"secret"}`+"\n", buf.String())
+
+	assertEncodeEqualsMarshalJSON(t, &Options{Groups: []string{"api"}}, v)
+	assertEncodeEqualsMarshalJSON(t, &Options{KeyTransformer: SnakeCase}, TestExposedFieldsCaseModel{UserName: "name", Override: "override"})
+}
+
+func TestEncoder_EncodeCycle(t *testing.T) {
+	self := &TestCycleNode{Name: "self"}
+	self.Parent = self
+
+	var buf bytes.Buffer
+	err := NewEncoder(&buf, &Options{}).Encode(self)
+	assert.IsType(t, CyclicReferenceError{}, err)
+
+	assertEncodeEqualsMarshalJSON(t, &Options{OnCycle: CycleNil}, self)
+}
+
+func TestEncoder_EncodeRequireStruct(t *testing.T) {
+	o := &Options{RequireStruct: true}
+
+	var buf bytes.Buffer
+	err := NewEncoder(&buf, o).Encode([]string{"not", "structs"})
+	assert.IsType(t, MarshalInvalidTypeError{}, err)
+	assert.Empty(t, buf.String())
+
+	assertEncodeEqualsMarshalJSON(t, o, []TestGroupsModel{{}})
+}
@@ -0,0 +1,153 @@
+package sheriff
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// FieldExposure returns, for each key of the map a struct of type t is marshalled to, the groups which
+// output that key if requested on their own. Keys which aren't output for any of the groups are omitted.
+// This is useful to e.g. document the fields of an API per group.
+//
+// The groups checked are options.Groups, options.DefaultGroups or, if both are empty, the groups found in the tags of t as well as
+// options.DefaultGroup, except the wildcard group "*". All other options, e.g. ApiVersion, are applied like Marshal does.
+// Fields promoted from embedded structs are included, fields of other nested structs are not.
+//
+// If t is neither a struct nor a pointer to a struct, a MarshalInvalidTypeError is returned.
+func FieldExposure(t reflect.Type, options *Options) (map[string][]string, error) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, MarshalInvalidTypeError{t: t.Kind()}
+	}
+
+	options, err := resolveOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	candidates := options.Groups
+	if len(candidates) == 0 {
+		candidates = tagGroups(options, t)
+	}
+
+	exposure := make(map[string][]string)
+	for _, group := range candidates {
+		o := *options
+		o.Groups = []string{group}
+		groups := make(groupSet)
+		groups.incrementGroups(o.Groups)
+
+		names := make(map[string]bool)
+		if err := exposedNames(&o, t, groups, make(groupSet), false, make(map[reflect.Type]bool), names); err != nil {
+			return nil, err
+		}
+		for name := range names {
+			exposure[name] = append(exposure[name], group)
+		}
+	}
+	return exposure, nil
+}
+
+// exposedNames adds the keys output for the fields of the struct type t to names,
+// following the same rules as marshalFields.
+func exposedNames(options *Options, t reflect.Type, groups, parents groupSet, embeddedParents bool, visiting map[reflect.Type]bool, names map[string]bool) error {
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	fields := cachedFields(options, t)
+	for i := range fields {
+		field := withGroupOverrides(options, &fields[i], t, i)
+		structField := t.Field(i)
+		// unexported fields are never marshalled
+		if (field.skip && !groups.containsAny(field.includeGroupNames)) || structField.PkgPath != "" {
+			continue
+		}
+		if !options.RejectUnsupported && isUnsupportedKind(structField.Type.Kind()) {
+			continue
+		}
+
+		fieldType := structField.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		isEmbeddedField := field.anonymous && fieldType.Kind() == reflect.Struct
+		shouldShow, parentGroups, err := shouldMarshalField(options, field, isEmbeddedField, groups, parents, embeddedParents)
+		if err != nil {
+			return err
+		}
+		if !shouldShow {
+			continue
+		}
+		// only the fields of t and its embedded structs are checked, which are all selectable
+		if !isEmbeddedField && !isFieldSelected(options, field.name) {
+			continue
+		}
+
+		if embedded := embeddedStructType(structField, defaultString(options.FieldTag, "json"), options.IgnoreStringer); embedded != nil {
+			// embedded structs embedding each other are only followed once
+			if visiting[embedded] {
+				continue
+			}
+			embeddedNames := make(map[string]bool)
+			childParents := enterField(options, parents, parentGroups, true)
+			err := exposedNames(options, embedded, groups, childParents, true, visiting, embeddedNames)
+			leaveField(options, parents, parentGroups, true)
+			if err != nil {
+				return err
+			}
+			for name := range embeddedNames {
+				if !isShadowed(options, field, name) {
+					names[name] = true
+				}
+			}
+			continue
+		}
+		if !field.shadowedNames[field.name] {
+			names[fieldName(options, field)] = true
+		}
+	}
+	return nil
+}
+
+// tagGroups returns the sorted groups of the tags of the struct type t and its embedded structs
+// as well as options.DefaultGroup. The wildcard group "*" isn't included.
+func tagGroups(options *Options, t reflect.Type) []string {
+	found := make(map[string]bool)
+	if options.DefaultGroup != "" {
+		found[options.DefaultGroup] = true
+	}
+	collectTagGroups(options, t, make(map[reflect.Type]bool), found)
+
+	groups := make([]string, 0, len(found))
+	for group := range found {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+func collectTagGroups(options *Options, t reflect.Type, visiting map[reflect.Type]bool, found map[string]bool) {
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	fields := cachedFields(options, t)
+	for i := range fields {
+		field := withGroupOverrides(options, &fields[i], t, i)
+		for _, names := range [][]string{field.groupNames, field.negatedGroupNames, field.excludedGroupNames} {
+			for _, name := range names {
+				// the wildcard isn't a group of its own
+				if name != wildcardGroup && !strings.HasPrefix(name, excludedGroupPrefix) {
+					found[name] = true
+				}
+			}
+		}
+		for group := range field.aliases {
+			found[group] = true
+		}
+		if embedded := embeddedStructType(t.Field(i), defaultString(options.FieldTag, "json"), options.IgnoreStringer); embedded != nil && !visiting[embedded] {
+			collectTagGroups(options, embedded, visiting, found)
+		}
+	}
+}
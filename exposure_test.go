@@ -0,0 +1,86 @@
+package sheriff
+
+import (
+	"reflect"
+	"testing"
+
+	version "github.com/hashicorp/go-version"
+	"github.com/stretchr/testify/assert"
+)
+
+type ExposureEmbedded struct {
+	Embedded string `json:"embedded"`
+	Internal string `json:"internal" groups:"internal"`
+	Shadowed string `json:"name" groups:"internal"`
+}
+
+type TestExposureModel struct {
+	ExposureEmbedded `groups:"api"`
+	Name             string         `json:"name" groups:"api,admin"`
+	Email            string         `json:"email" groups:"admin" exclude_groups:"internal"`
+	UserID           string         `json:"user_id" groups:"api,internal" alias:"internal=uid"`
+	NotPublic        string         `json:"not_public" groups:"!api"`
+	Since2           string         `json:"since_2" groups:"api" since:"2"`
+	Child            UnmarshalChild `json:"child" groups:"admin"`
+	Ungrouped        string         `json:"ungrouped"`
+	Skipped          string         `json:"-" groups:"api"`
+}
+
+func TestFieldExposure(t *testing.T) {
+	exposure, err := FieldExposure(reflect.TypeOf(TestExposureModel{}), &Options{ApiVersion: version.Must(version.NewVersion("1.0.0"))})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"embedded":   {"api"},
+		"internal":   {"internal"},
+		"name":       {"admin", "api"},
+		"email":      {"admin"},
+		"user_id":    {"api"},
+		"uid":        {"internal"},
+		"not_public": {"admin", "internal"},
+		"child":      {"admin"},
+	}, exposure)
+
+	exposure, err = FieldExposure(reflect.TypeOf(&TestExposureModel{}), &Options{Groups: []string{"api", "other"}, OutputFieldsWithNoGroup: true})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"embedded":   {"api", "other"},
+		"name":       {"api"},
+		"user_id":    {"api"},
+		"not_public": {"other"},
+		"since_2":    {"api"},
+		"ungrouped":  {"api", "other"},
+	}, exposure)
+
+	exposure, err = FieldExposure(reflect.TypeOf(TestExposureModel{}), &Options{DefaultGroup: "default"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"default"}, exposure["ungrouped"])
+
+	_, err = FieldExposure(reflect.TypeOf(""), &Options{})
+	assert.IsType(t, MarshalInvalidTypeError{}, err)
+}
+
+func TestFieldExposure_SelectedFields(t *testing.T) {
+	exposure, err := FieldExposure(reflect.TypeOf(TestExposureModel{}), &Options{OnlyFields: []string{"name", "embedded", "email"}, ExcludeFields: []string{"email"}})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"embedded": {"api"},
+		"name":     {"admin", "api"},
+	}, exposure)
+}
+
+type TestExposureWildcardModel struct {
+	A    string `json:"a" groups:"api"`
+	Star string `json:"star" groups:"*"`
+	B    string `json:"b" groups:"debug"`
+}
+
+func TestFieldExposure_Wildcard(t *testing.T) {
+	// fields with the wildcard group are output for every group, which isn't a group on its own
+	exposure, err := FieldExposure(reflect.TypeOf(TestExposureWildcardModel{}), &Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"a":    {"api"},
+		"star": {"api", "debug"},
+		"b":    {"debug"},
+	}, exposure)
+}
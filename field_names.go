@@ -0,0 +1,137 @@
+package sheriff
+
+import "reflect"
+
+// nameCandidate is a field providing a key in the output map of a struct.
+type nameCandidate struct {
+	// index is the index of the field in the struct, for promoted fields the index of the embedded field
+	index int
+	// depth is the level of embedding, 0 for fields of the struct itself
+	depth int
+	// tagged is set if the name has been given by the field tag
+	tagged bool
+}
+
+// resolveNames applies the rules of encoding/json to the names of the fields in the struct key.t,
+// including fields promoted from embedded structs:
+// a name of a shallower field hides the same name of deeper ones and if multiple fields have a name
+// on the same depth, the one given by a field tag is used. If there are none or multiple of those,
+// the name is dropped.
+//
+// It returns the dominant field of each name and for each field index the names it loses.
+func resolveNames(key typeCacheKey, visiting map[reflect.Type]bool) (map[string]nameCandidate, map[int]map[string]bool) {
+	visiting[key.t] = true
+	defer delete(visiting, key.t)
+
+	candidates := make(map[string][]nameCandidate)
+	for i := 0; i < key.t.NumField(); i++ {
+		field := key.t.Field(i)
+		// unexported fields are never marshalled
+		if field.PkgPath != "" {
+			continue
+		}
+		name, _ := ParseTag(field.Tag.Get(key.fieldTag))
+		if name == "-" {
+			continue
+		}
+
+		if t := embeddedStructType(field, key.fieldTag, key.ignoreStringer); t != nil {
+			// avoid following embedded structs which embed each other forever
+			if visiting[t] {
+				continue
+			}
+			embeddedKey := key
+			embeddedKey.t = t
+			dominants, _ := resolveNames(embeddedKey, visiting)
+			for embeddedName, c := range dominants {
+				candidates[embeddedName] = append(candidates[embeddedName], nameCandidate{index: i, depth: c.depth + 1, tagged: c.tagged})
+			}
+			continue
+		}
+
+		tagged := name != ""
+		if !tagged {
+			name = field.Name
+		}
+		candidates[name] = append(candidates[name], nameCandidate{index: i, tagged: tagged})
+	}
+
+	dominants := make(map[string]nameCandidate)
+	lost := make(map[int]map[string]bool)
+	for name, cs := range candidates {
+		dominant, ok := dominantName(cs)
+		if ok {
+			dominants[name] = dominant
+		}
+		for _, c := range cs {
+			if ok && c == dominant {
+				continue
+			}
+			if lost[c.index] == nil {
+				lost[c.index] = make(map[string]bool)
+			}
+			lost[c.index][name] = true
+		}
+	}
+	return dominants, lost
+}
+
+// dominantName returns the candidate which provides a name, if any.
+func dominantName(cs []nameCandidate) (nameCandidate, bool) {
+	minDepth := cs[0].depth
+	for _, c := range cs[1:] {
+		if c.depth < minDepth {
+			minDepth = c.depth
+		}
+	}
+
+	var dominant nameCandidate
+	found, tagged := 0, 0
+	for _, c := range cs {
+		if c.depth != minDepth {
+			continue
+		}
+		found++
+		if c.tagged {
+			tagged++
+			dominant = c
+		} else if tagged == 0 {
+			dominant = c
+		}
+	}
+	if found == 1 || tagged == 1 {
+		return dominant, true
+	}
+	return nameCandidate{}, false
+}
+
+// isInlineField checks whether field is an embedded field or has the `inline` option in its field tag,
+// e.g. `json:",inline"`, both of which promote the fields of a struct to the embedding struct.
+func isInlineField(field reflect.StructField, fieldTag string) bool {
+	if field.Anonymous {
+		return true
+	}
+	_, opts := ParseTag(field.Tag.Get(fieldTag))
+	return opts.Contains("inline")
+}
+
+// embeddedStructType returns the struct type of an embedded or inline field whose fields are promoted
+// to the output map of the embedding struct, or nil.
+func embeddedStructType(field reflect.StructField, fieldTag string, ignoreStringer bool) reflect.Type {
+	if !isInlineField(field, fieldTag) {
+		return nil
+	}
+	t := field.Type
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	// such types aren't marshalled into a map
+	if t.Implements(marshallerType) || t.Implements(contextMarshallerType) || t.Implements(jsonMarshalerType) ||
+		t.Implements(textMarshalerType) || t.Implements(binaryMarshalerType) || (!ignoreStringer && t.Implements(stringerType)) {
+		return nil
+	}
+	return t
+}
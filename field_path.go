@@ -0,0 +1,60 @@
+package sheriff
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// fieldPath is the location of the value currently being marshalled within the passed data, e.g. ".Items[2].Owner".
+// Like a pointerSet, elements are added before marshalling a nested value and removed afterwards. They are only
+// formatted when the path is actually needed.
+type fieldPath struct {
+	elems []pathElem
+}
+
+// pathElem is the name of a struct field, the key of a map or the index of a slice element.
+type pathElem struct {
+	kind  pathElemKind
+	name  string
+	index int
+}
+
+type pathElemKind int
+
+const (
+	fieldElem pathElemKind = iota
+	keyElem
+	indexElem
+)
+
+func (p *fieldPath) pushField(name string) {
+	p.elems = append(p.elems, pathElem{kind: fieldElem, name: name})
+}
+
+func (p *fieldPath) pushKey(key string) {
+	p.elems = append(p.elems, pathElem{kind: keyElem, name: key})
+}
+
+func (p *fieldPath) pushIndex(i int) {
+	p.elems = append(p.elems, pathElem{kind: indexElem, index: i})
+}
+
+func (p *fieldPath) pop() {
+	p.elems = p.elems[:len(p.elems)-1]
+}
+
+// String formats the path like the Path of a MarshalInvalidTypeError, e.g. ".Preferences[key][1]".
+func (p *fieldPath) String() string {
+	var b bytes.Buffer
+	for _, e := range p.elems {
+		switch e.kind {
+		case fieldElem:
+			b.WriteString("." + e.name)
+		case keyElem:
+			b.WriteString("[" + e.name + "]")
+		case indexElem:
+			b.WriteString("[" + strconv.Itoa(e.index) + "]")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,23 @@
+package sheriff
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFieldPath_String(t *testing.T) {
+	p := &fieldPath{}
+	assert.Equal(t, "", p.String())
+
+	p.pushField("Preferences")
+	p.pushKey("key")
+	p.pushIndex(1)
+	p.pushKey("")
+	assert.Equal(t, ".Preferences[key][1][]", p.String())
+
+	p.pop()
+	p.pop()
+	p.pushField("Values")
+	assert.Equal(t, ".Preferences[key].Values", p.String())
+}
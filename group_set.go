@@ -1,5 +1,20 @@
 package sheriff
 
+import (
+	"sort"
+	"strings"
+)
+
+// wildcardGroup is the requested group matching every field having a group.
+const wildcardGroup = "*"
+
+// additiveGroupPrefix marks a group of a struct field which is added to the groups of the fields of its value,
+// e.g. `groups:"+audit"`. In a groupSet of parents, it marks the additive groups passed on.
+const additiveGroupPrefix = "+"
+
+// excludedGroupPrefix marks a requested group excluding the fields having that group, e.g. "-secret".
+const excludedGroupPrefix = "-"
+
 type groupSet map[string]int
 
 func (s groupSet) incrementGroups(groups []string) {
@@ -26,3 +41,132 @@ func (s groupSet) containsAny(groups []string) bool {
 	}
 	return false
 }
+
+// containsAnyExcluded checks whether one of groups is requested with the excludedGroupPrefix.
+func (s groupSet) containsAnyExcluded(groups []string) bool {
+	for i := range groups {
+		if s.contains(excludedGroupPrefix + groups[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s groupSet) containsAnyGroup() bool {
+	for _, count := range s {
+		if count > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s groupSet) containsAll(groups []string) bool {
+	if len(groups) == 0 {
+		return false
+	}
+	for i := range groups {
+		if !s.contains(groups[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// groups returns the sorted groups contained in s, except for the markers of additive groups.
+func (s groupSet) groups() []string {
+	var groups []string
+	for group, count := range s {
+		if count > 0 && !strings.HasPrefix(group, additiveGroupPrefix) {
+			groups = append(groups, group)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// additiveGroups returns the additive groups passed on by the parents in s.
+func (s groupSet) additiveGroups() []string {
+	var groups []string
+	for group, count := range s {
+		if count > 0 && strings.HasPrefix(group, additiveGroupPrefix) {
+			groups = append(groups, group[len(additiveGroupPrefix):])
+		}
+	}
+	return groups
+}
+
+// descend returns the groups inherited by the fields of a struct whose field passes on groups, where the counts
+// are the number of levels a group is inherited for. The groups of s lose a level unless the fields are promoted
+// from an embedded struct, while groups apply to depth levels.
+func (s groupSet) descend(groups []string, depth int, embedded bool) groupSet {
+	child := make(groupSet, len(s)+len(groups))
+	for group, levels := range s {
+		if !embedded {
+			levels--
+		}
+		if levels > 0 {
+			child[group] = levels
+		}
+	}
+	for _, group := range groups {
+		if child[group] < depth {
+			child[group] = depth
+		}
+	}
+	return child
+}
+
+// splitAdditiveGroups removes the `+` prefix of additive groups from groupNames and also returns them separately.
+func splitAdditiveGroups(groupNames []string) (groups, additive []string) {
+	for _, name := range groupNames {
+		if strings.HasPrefix(name, additiveGroupPrefix) {
+			name = name[len(additiveGroupPrefix):]
+			additive = append(additive, name)
+		}
+		groups = append(groups, name)
+	}
+	return groups, additive
+}
+
+// markAdditive prefixes groups with the additiveGroupPrefix in order to pass them on as additive groups.
+func markAdditive(groups []string) []string {
+	marked := make([]string, len(groups))
+	for i, group := range groups {
+		marked[i] = additiveGroupPrefix + group
+	}
+	return marked
+}
+
+// splitGroups splits the groups of a tag separated by sep. A separator preceded by a backslash
+// is part of a group instead, e.g. `org\,team,admin` contains "org,team" and "admin".
+func splitGroups(s, sep string) []string {
+	var groups []string
+	var escaped string
+	for {
+		i := strings.Index(s, sep)
+		if i == -1 {
+			return append(groups, escaped+s)
+		}
+		if i > 0 && s[i-1] == '\\' {
+			escaped += s[:i-1] + sep
+		} else {
+			groups = append(groups, escaped+s[:i])
+			escaped = ""
+		}
+		s = s[i+len(sep):]
+	}
+}
+
+// splitNegatedGroups separates the groups prefixed with `!` from the others.
+// The prefix is removed from the returned negated groups.
+func splitNegatedGroups(groupNames []string) (groups, negated []string) {
+	for _, name := range groupNames {
+		if strings.HasPrefix(name, "!") {
+			negated = append(negated, name[1:])
+		} else {
+			groups = append(groups, name)
+		}
+	}
+	return groups, negated
+}
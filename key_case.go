@@ -0,0 +1,42 @@
+package sheriff
+
+import (
+	"bytes"
+	"unicode"
+)
+
+// SnakeCase converts a key like "userID" or "UserName" to "user_id" or "user_name".
+// It can be used as Options.KeyTransformer.
+func SnakeCase(key string) string {
+	return delimitWords(key, '_')
+}
+
+// KebabCase converts a key like "userID" or "UserName" to "user-id" or "user-name".
+// It can be used as Options.KeyTransformer.
+func KebabCase(key string) string {
+	return delimitWords(key, '-')
+}
+
+// delimitWords lowercases s and separates its words using delimiter. A word starts at an upper case
+// letter following a lower case letter or digit, or at the last upper case letter of an acronym which
+// is followed by a lower case letter, e.g. "HTTPServer" becomes "http", "server".
+// Existing underscores, hyphens and spaces are replaced by delimiter.
+func delimitWords(s string, delimiter rune) string {
+	runes := []rune(s)
+	var b bytes.Buffer
+	for i, r := range runes {
+		if r == '_' || r == '-' || r == ' ' {
+			b.WriteRune(delimiter)
+			continue
+		}
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			acronymEnd := unicode.IsUpper(prev) && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || acronymEnd {
+				b.WriteRune(delimiter)
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
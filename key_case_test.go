@@ -0,0 +1,34 @@
+package sheriff
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnakeCase(t *testing.T) {
+	for key, expected := range map[string]string{
+		"userName":    "user_name",
+		"UserName":    "user_name",
+		"userID":      "user_id",
+		"HTTPServer":  "http_server",
+		"address2":    "address2",
+		"line2Street": "line2_street",
+		"kebab-case":  "kebab_case",
+		"snake_case":  "snake_case",
+		"":            "",
+	} {
+		assert.Equal(t, expected, SnakeCase(key), key)
+	}
+}
+
+func TestKebabCase(t *testing.T) {
+	for key, expected := range map[string]string{
+		"userName":   "user-name",
+		"userID":     "user-id",
+		"HTTPServer": "http-server",
+		"snake_case": "snake-case",
+	} {
+		assert.Equal(t, expected, KebabCase(key), key)
+	}
+}
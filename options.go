@@ -0,0 +1,129 @@
+package sheriff
+
+import version "github.com/hashicorp/go-version"
+
+// An Option sets a field of Options, see MarshalWith.
+type Option func(options *Options) error
+
+// MarshalWith encodes the passed data like Marshal does, using the Options set by opts.
+//
+// For example:
+//
+//	sheriff.MarshalWith(user, sheriff.WithGroups("admin"), sheriff.WithApiVersion("2.0.0"))
+func MarshalWith(data interface{}, opts ...Option) (interface{}, error) {
+	options := &Options{}
+	for _, opt := range opts {
+		if err := opt(options); err != nil {
+			return nil, err
+		}
+	}
+	return Marshal(options, data)
+}
+
+// WithGroups adds groups to Options.Groups.
+func WithGroups(groups ...string) Option {
+	return func(options *Options) error {
+		options.Groups = append(options.Groups, groups...)
+		return nil
+	}
+}
+
+// WithApiVersion sets Options.ApiVersion to the parsed version v.
+func WithApiVersion(v string) Option {
+	return func(options *Options) error {
+		apiVersion, err := version.NewVersion(v)
+		if err != nil {
+			return err
+		}
+		options.ApiVersion = apiVersion
+		return nil
+	}
+}
+
+// WithInheritGroups sets Options.InheritGroups.
+func WithInheritGroups() Option {
+	return func(options *Options) error {
+		options.InheritGroups = true
+		return nil
+	}
+}
+
+// WithOutputFieldsWithNoGroup sets Options.OutputFieldsWithNoGroup.
+func WithOutputFieldsWithNoGroup() Option {
+	return func(options *Options) error {
+		options.OutputFieldsWithNoGroup = true
+		return nil
+	}
+}
+
+// NewOptions returns empty Options, to be set using its With methods.
+//
+// For example:
+//
+//	options := sheriff.NewOptions().WithGroups("admin").WithApiVersion("2.0.0")
+func NewOptions() *Options {
+	return &Options{}
+}
+
+// WithGroups adds groups to Options.Groups and returns o.
+func (o *Options) WithGroups(groups ...string) *Options {
+	return o.apply(WithGroups(groups...))
+}
+
+// WithApiVersion sets Options.ApiVersion to the parsed version v and returns o.
+// If v is not a valid version, the error is returned once the options are used, e.g. by Marshal.
+func (o *Options) WithApiVersion(v string) *Options {
+	return o.apply(WithApiVersion(v))
+}
+
+// WithInheritGroups sets Options.InheritGroups and returns o.
+func (o *Options) WithInheritGroups() *Options {
+	return o.apply(WithInheritGroups())
+}
+
+// WithOutputFieldsWithNoGroup sets Options.OutputFieldsWithNoGroup and returns o.
+func (o *Options) WithOutputFieldsWithNoGroup() *Options {
+	return o.apply(WithOutputFieldsWithNoGroup())
+}
+
+// apply sets opt on o, keeping the first error to return it once the options are used.
+func (o *Options) apply(opt Option) *Options {
+	if err := opt(o); err != nil && o.err == nil {
+		o.err = err
+	}
+	return o
+}
+
+// Clone returns a copy of the options whose slices and maps, e.g. Groups, can be modified without affecting o.
+// The ApiVersion and TimeLocation are shared, as neither is modified once created.
+// Marshal never modifies the passed options, so the same Options can be used concurrently as long as they
+// aren't modified, while Clone allows deriving options per request.
+func (o *Options) Clone() *Options {
+	c := *o
+	c.Groups = cloneStrings(o.Groups)
+	c.DefaultGroups = cloneStrings(o.DefaultGroups)
+	c.OnlyFields = cloneStrings(o.OnlyFields)
+	c.ExcludeFields = cloneStrings(o.ExcludeFields)
+	c.KnownGroups = cloneStrings(o.KnownGroups)
+	if o.FieldGroupOverrides != nil {
+		c.FieldGroupOverrides = make(map[string][]string, len(o.FieldGroupOverrides))
+		for name, groups := range o.FieldGroupOverrides {
+			c.FieldGroupOverrides[name] = cloneStrings(groups)
+		}
+	}
+	if o.FieldTransformers != nil {
+		c.FieldTransformers = make(map[string]func(value interface{}) interface{}, len(o.FieldTransformers))
+		for name, transform := range o.FieldTransformers {
+			c.FieldTransformers[name] = transform
+		}
+	}
+	return &c
+}
+
+// cloneStrings returns a copy of s, which is nil if s is nil.
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append(make([]string, 0, len(s)), s...)
+}
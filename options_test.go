@@ -0,0 +1,98 @@
+package sheriff
+
+import (
+	"testing"
+
+	version "github.com/hashicorp/go-version"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalWith(t *testing.T) {
+	v := TestVersionsModel{
+		DefaultMarshal: "DefaultMarshal",
+		Until20:        "Until20",
+		Since21:        "Since21",
+	}
+
+	expected, err := Marshal(&Options{ApiVersion: version.Must(version.NewVersion("2.0.0"))}, v)
+	assert.NoError(t, err)
+	actual, err := MarshalWith(v, WithApiVersion("2.0.0"))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actual)
+
+	_, err = MarshalWith(v, WithApiVersion("invalid"))
+	assert.Error(t, err)
+
+	w := TestWildcardModel{
+		Grouped:   "grouped",
+		Ungrouped: "ungrouped",
+		Inherited: HalfTagged{WithTag: "with_tag", WithoutTag: "without_tag"},
+	}
+	expected, err = Marshal(&Options{Groups: []string{"a", "b"}, InheritGroups: true, OutputFieldsWithNoGroup: true}, w)
+	assert.NoError(t, err)
+	actual, err = MarshalWith(w, WithGroups("a"), WithGroups("b"), WithInheritGroups(), WithOutputFieldsWithNoGroup())
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestNewOptions(t *testing.T) {
+	expected := &Options{
+		Groups:                  []string{"a", "b"},
+		ApiVersion:              version.Must(version.NewVersion("2.1.0")),
+		InheritGroups:           true,
+		OutputFieldsWithNoGroup: true,
+	}
+	actual := NewOptions().WithGroups("a").WithGroups("b").WithApiVersion("2.1.0").WithInheritGroups().WithOutputFieldsWithNoGroup()
+	assert.Equal(t, expected, actual)
+
+	w := TestWildcardModel{
+		Grouped:   "grouped",
+		Ungrouped: "ungrouped",
+		Inherited: HalfTagged{WithTag: "with_tag", WithoutTag: "without_tag"},
+	}
+	expectedData, err := Marshal(expected, w)
+	assert.NoError(t, err)
+	actualData, err := Marshal(actual, w)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedData, actualData)
+}
+
+func TestNewOptions_InvalidApiVersion(t *testing.T) {
+	options := NewOptions().WithApiVersion("invalid").WithApiVersion("2.0.0")
+	assert.Error(t, options.err)
+
+	_, err := Marshal(options, TestVersionsModel{})
+	assert.Equal(t, options.err, err)
+	_, err = MarshalJSON(options, TestVersionsModel{})
+	assert.Equal(t, options.err, err)
+}
+
+func TestOptions_Clone(t *testing.T) {
+	original := &Options{
+		Groups:            make([]string, 1, 2),
+		DefaultGroups:     []string{"default"},
+		ApiVersion:        version.Must(version.NewVersion("2.0.0")),
+		InheritGroups:     true,
+		FieldTransformers: map[string]func(value interface{}) interface{}{"nil": func(interface{}) interface{} { return nil }},
+	}
+	original.Groups[0] = "api"
+
+	clone := original.Clone()
+	assert.Equal(t, original.Groups, clone.Groups)
+	assert.Equal(t, original.DefaultGroups, clone.DefaultGroups)
+	assert.Equal(t, original.ApiVersion, clone.ApiVersion)
+	assert.True(t, clone.InheritGroups)
+	assert.Len(t, clone.FieldTransformers, 1)
+	assert.Nil(t, clone.OnlyFields)
+
+	// appending to the clone must not write into the spare capacity of the original
+	clone.Groups = append(clone.Groups, "admin")
+	clone.Groups[0] = "public"
+	clone.DefaultGroups[0] = "changed"
+	clone.FieldTransformers["other"] = nil
+	grown := original.Groups[:2]
+	assert.Equal(t, []string{"api", ""}, grown)
+	assert.Equal(t, []string{"api"}, original.Groups)
+	assert.Equal(t, []string{"default"}, original.DefaultGroups)
+	assert.Len(t, original.FieldTransformers, 1)
+}
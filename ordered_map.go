@@ -0,0 +1,85 @@
+package sheriff
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// KeyValue is an entry of an OrderedMap.
+type KeyValue struct {
+	Key   string
+	Value interface{}
+}
+
+// OrderedMap is returned by Marshal for structs instead of a map[string]interface{} if
+// Options.PreserveOrder is set. Its entries are in the order of the struct fields, which is
+// kept by its JSON encoding.
+type OrderedMap []KeyValue
+
+// MarshalJSON encodes the entries as a JSON object in their order.
+func (m OrderedMap) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, kv := range m {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, err := json.Marshal(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		value, err := json.Marshal(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// Map returns the entries as a map[string]interface{}.
+func (m OrderedMap) Map() map[string]interface{} {
+	dest := make(map[string]interface{}, len(m))
+	for _, kv := range m {
+		dest[kv.Key] = kv.Value
+	}
+	return dest
+}
+
+// orderedMapBuilder builds an OrderedMap. Like for a map, setting a key again replaces its value,
+// while its position is kept.
+type orderedMapBuilder struct {
+	m       OrderedMap
+	indexes map[string]int
+}
+
+func (b *orderedMapBuilder) set(key string, value interface{}) {
+	if i, ok := b.indexes[key]; ok {
+		b.m[i].Value = value
+		return
+	}
+	if b.indexes == nil {
+		b.indexes = make(map[string]int)
+	}
+	b.indexes[key] = len(b.m)
+	b.m = append(b.m, KeyValue{Key: key, Value: value})
+}
+
+// marshalledEntries returns the entries of a marshalled struct, i.e. a map[string]interface{}
+// or an OrderedMap. The entries of a map are in no particular order.
+func marshalledEntries(v interface{}) (OrderedMap, bool) {
+	switch m := v.(type) {
+	case OrderedMap:
+		return m, true
+	case map[string]interface{}:
+		entries := make(OrderedMap, 0, len(m))
+		for k, v := range m {
+			entries = append(entries, KeyValue{Key: k, Value: v})
+		}
+		return entries, true
+	}
+	return nil, false
+}
@@ -0,0 +1,71 @@
+package sheriff
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type OrderedEmbedded struct {
+	Embedded1 string `json:"embedded_1"`
+	Embedded2 string `json:"embedded_2"`
+}
+
+type OrderedChild struct {
+	Z string `json:"z"`
+	A string `json:"a"`
+}
+
+type TestOrderedModel struct {
+	Zebra string `json:"zebra"`
+	OrderedEmbedded
+	Apple    string            `json:"apple"`
+	Child    OrderedChild      `json:"child"`
+	Children []OrderedChild    `json:"children"`
+	Map      map[string]string `json:"map"`
+	Empty    OrderedChild      `json:"empty,omitempty" groups:"other"`
+	Hidden   string            `json:"hidden" groups:"other"`
+}
+
+func TestMarshal_PreserveOrder(t *testing.T) {
+	v := TestOrderedModel{
+		Zebra:           "zebra",
+		OrderedEmbedded: OrderedEmbedded{"e1", "e2"},
+		Apple:           "apple",
+		Child:           OrderedChild{"z", "a"},
+		Children:        []OrderedChild{{"z", "a"}},
+		Map:             map[string]string{"b": "b", "a": "a"},
+		Hidden:          "hidden",
+	}
+	expected := `{"zebra":"zebra","embedded_1":"e1","embedded_2":"e2","apple":"apple","child":{"z":"z","a":"a"},` +
+		`"children":[{"z":"z","a":"a"}],"map":{"a":"a","b":"b"},"empty":{"z":"","a":""},"hidden":"hidden"}`
+
+	for i := 0; i < 10; i++ {
+		actual, err := MarshalJSON(&Options{PreserveOrder: true}, v)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(actual))
+	}
+
+	actual, err := Marshal(&Options{Groups: []string{"api"}, OutputFieldsWithNoGroup: true, PreserveOrder: true}, v)
+	assert.NoError(t, err)
+	assert.Equal(t, OrderedMap{
+		{"zebra", "zebra"},
+		{"embedded_1", "e1"},
+		{"embedded_2", "e2"},
+		{"apple", "apple"},
+		{"child", OrderedMap{{"z", "z"}, {"a", "a"}}},
+		{"children", []interface{}{OrderedMap{{"z", "z"}, {"a", "a"}}}},
+		{"map", map[string]interface{}{"b": "b", "a": "a"}},
+	}, actual)
+}
+
+func TestOrderedMap_MarshalJSON(t *testing.T) {
+	b, err := json.Marshal(OrderedMap{{"b", 1}, {"a", []string{"x"}}, {"c", nil}})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"b":1,"a":["x"],"c":null}`, string(b))
+
+	b, err = json.Marshal(OrderedMap{})
+	assert.NoError(t, err)
+	assert.Equal(t, `{}`, string(b))
+}
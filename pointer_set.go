@@ -0,0 +1,25 @@
+package sheriff
+
+import "reflect"
+
+// pointerKey identifies a pointer by its address and type, as a pointer to a struct
+// and a pointer to its first field share the same address.
+type pointerKey struct {
+	ptr uintptr
+	t   reflect.Type
+}
+
+// pointerSet contains the pointers currently being marshalled.
+type pointerSet map[pointerKey]int
+
+func (s pointerSet) add(v reflect.Value) {
+	s[pointerKey{v.Pointer(), v.Type()}]++
+}
+
+func (s pointerSet) remove(v reflect.Value) {
+	s[pointerKey{v.Pointer(), v.Type()}]--
+}
+
+func (s pointerSet) contains(v reflect.Value) bool {
+	return s[pointerKey{v.Pointer(), v.Type()}] > 0
+}
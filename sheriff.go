@@ -1,11 +1,16 @@
 package sheriff
 
 import (
+	"context"
 	"encoding"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	version "github.com/hashicorp/go-version"
 )
@@ -15,14 +20,31 @@ type Options struct {
 	// Groups determine which fields are getting marshalled based on the groups tag.
 	// A field with multiple groups (comma-separated) will result in marshalling of that
 	// field if one of their groups is specified.
+	// The group "*" matches every field having at least one group. Other groups specified
+	// along with it are still used for negated and excluded groups as well as aliases.
+	// A group prefixed with "-" excludes every field having that group, even if another of
+	// its groups matches, e.g. []string{"*", "-secret"}. It never causes a field to be output.
+	// A field having the group "*" is output regardless of the requested groups.
 	Groups []string
+	// DefaultGroups are used instead of Groups if no Groups are specified.
+	// Specifying any Groups overrides DefaultGroups entirely.
+	DefaultGroups []string
 	// ApiVersion sets the API version to use when marshalling.
 	// The tags `since` and `until` use the API version setting.
 	// Specifying the API version as "1.0.0" and having an until setting of "2"
 	// will result in the field being marshalled.
 	// Specifying a since setting of "2" with the same API version specified,
 	// will not marshal the field.
+	// If ApiVersion is nil, the `since` and `until` tags are ignored.
+	//
+	// Versions are compared using SemVer precedence, build metadata is ignored.
+	// A pre-release is lower than its release, i.e. "2.0.0-rc1" satisfies `until:"2.0.0"`
+	// but not `since:"2.0.0"`, see ReleasePrecedence for changing this.
 	ApiVersion *version.Version
+	// ReleasePrecedence causes a pre-release ApiVersion like "2.0.0-rc1" to be compared
+	// as its release "2.0.0", so e.g. a staging environment running release candidates
+	// outputs the same fields as the final release.
+	ReleasePrecedence bool
 
 	// OutputFieldWithNoGroup causes fields with no group tag to be included in
 	// the output. Default behavior is to skip fields without a group tag.
@@ -31,41 +53,463 @@ type Options struct {
 	// fields, and only a small number are tagged as optional additional output.
 	OutputFieldsWithNoGroup bool
 
+	// DefaultGroup is the group of fields without a group tag. Such a field is
+	// only marshalled if DefaultGroup is specified in Groups, regardless of
+	// OutputFieldsWithNoGroup. If DefaultGroup is empty, fields without a group
+	// tag are handled as described for OutputFieldsWithNoGroup.
+	DefaultGroup string
+
 	// InheritGroups causes any group applied to a struct-type field to
 	// propagate to all fields of that struct.
 	InheritGroups bool
+	// MaxInheritDepth limits the number of nesting levels groups are inherited for with InheritGroups,
+	// e.g. 1 for only the fields of the struct itself. Fields promoted from embedded structs are
+	// on the same level as the fields of the embedding struct. 0 means unlimited.
+	MaxInheritDepth int
+
+	// MatchAllGroups changes group matching from "any of" to "all of": a field
+	// is only marshalled if every group in its groups tag is contained in Groups.
+	// When combined with InheritGroups or embedded fields, only groups of parents
+	// which matched completely are propagated to their children.
+	MatchAllGroups bool
+
+	// OmitEmpty causes all fields to be omitted if they are empty, as if they had the `omitempty` option.
+	// Like with the option, nil pointers are omitted while pointers to empty values are not, and structs
+	// are omitted if all of their fields are omitted, so a struct of zero values is omitted entirely.
+	// Fields with the `keepempty` option, e.g. `json:"count,keepempty"`, are output even if they're empty.
+	OmitEmpty bool
+	// OmitEmptyDeep causes pointers to be followed when checking whether a field is empty for `omitempty`,
+	// so e.g. a *string pointing to "" is omitted as well. Nil pointers are empty regardless.
+	OmitEmptyDeep bool
+	// OmitNilPointers causes struct fields holding a nil pointer to be omitted instead of being output as null,
+	// without omitting other empty values like OmitEmpty does. Nil interfaces, slices and maps are still output.
+	OmitNilPointers bool
+
+	// FlattenSingleElementSlices causes slices and arrays with exactly one element to be output as that element
+	// instead of an array, e.g. for consumers expecting a scalar. Empty slices and those with several elements
+	// are output as arrays, and nil slices as null. The passed data itself is never flattened.
+	FlattenSingleElementSlices bool
+
+	// IgnoreStringer causes values implementing fmt.Stringer to be marshalled like any other value, e.g. structs
+	// field by field applying the groups. By default they are left as is and passed to encoding/json, which
+	// outputs all of their fields. Values implementing json.Marshaler, encoding.TextMarshaler or
+	// encoding.BinaryMarshaler are left to those regardless.
+	IgnoreStringer bool
+
+	// FieldTag sets the struct tag which determines the output key of a field
+	// as well as the `omitempty` and `-` options, e.g. "yaml". Defaults to "json".
+	FieldTag string
+
+	// GroupTagName sets the struct tag containing the groups of a field. Defaults to "groups".
+	GroupTagName string
+	// GroupSeparator sets the separator of the groups in the group, groups_omitempty, groups_include and
+	// exclude_groups tags as well as of the pairs of the alias tag, e.g. "|". Defaults to ",". A separator preceded
+	// by a backslash is part of a group name, e.g. `groups:"org\\,team,admin"` contains the groups "org,team"
+	// and "admin".
+	GroupSeparator string
+	// SinceTagName sets the struct tag containing the since version of a field. Defaults to "since".
+	SinceTagName string
+	// UntilTagName sets the struct tag containing the until version of a field. Defaults to "until".
+	UntilTagName string
+
+	// OnCycle determines how a pointer referencing one of its parents is handled.
+	// Defaults to returning a CyclicReferenceError.
+	OnCycle CycleHandling
+
+	// FieldTransformers contains functions which are applied to the marshalled value of a field
+	// having a transform tag with the function's key, e.g. `transform:"maskEmail"`.
+	// They are useful to e.g. redact a field instead of omitting it.
+	FieldTransformers map[string]func(value interface{}) interface{}
+
+	// FieldFilter is called for every struct field which would be output otherwise, after evaluating its tags
+	// and before marshalling its value, so e.g. the Marshaller of an omitted field isn't called. If it returns
+	// false, the field is omitted. This allows deciding on fields depending on runtime data, e.g. the user
+	// requesting the data. It's not called for the fields of hidden structs, nor for embedded structs, but for
+	// their promoted fields, and it's not considered by FieldExposure.
+	FieldFilter func(field FieldInfo) bool
+
+	// FieldGroupOverrides adds groups to fields as if they were part of their group tag, keyed by the name of the
+	// struct type and field, e.g. "User.SSN". Negated groups like "!public" are supported as well. This allows
+	// trying out changes to the visibility of fields without editing their tags.
+	FieldGroupOverrides map[string][]string
+
+	// RequireStruct causes Marshal, Encoder.Encode and StreamMarshaller.MarshalStream to return a
+	// MarshalInvalidTypeError if the passed data is neither a struct nor a slice or array of structs, or
+	// pointers to those. This helps catching mistakes like passing a map or a string, which would otherwise
+	// be returned as is.
+	RequireStruct bool
+
+	// TimeFormat sets the layout used to format time.Time values instead of passing them to
+	// encoding/json, which uses RFC 3339. TimeFormatUnix outputs the Unix time as an int64.
+	// A field's timeformat tag takes precedence.
+	TimeFormat string
+	// TimeLocation sets the location time.Time values are converted to before formatting them
+	// using TimeFormat or a timeformat tag.
+	TimeLocation *time.Location
+
+	// KeyTransformer is applied to the key of every marshalled struct field, including aliases
+	// and fields of nested and embedded structs, e.g. SnakeCase. Keys of maps aren't transformed.
+	KeyTransformer func(key string) string
+
+	// PreserveOrder causes structs to be marshalled into an OrderedMap instead of a map[string]interface{},
+	// so their JSON encoding lists the fields in the order of their declaration. Fields promoted from
+	// embedded structs take the position of the embedded field.
+	PreserveOrder bool
+
+	// MapKeyFunc converts map keys which aren't strings to the keys of the output map, e.g. for key types
+	// which can't be used by encoding/json. If it's nil, integers and types implementing
+	// encoding.TextMarshaler are converted like encoding/json does and other key types cause a
+	// MarshalInvalidTypeError.
+	MapKeyFunc func(key reflect.Value) (string, error)
+
+	// MaxDepth limits the nesting of structs, slices, arrays and maps, e.g. 1 for a struct whose fields
+	// are neither of those. Exceeding it causes a MaxDepthError, which guards against excessively deep data.
+	// Fields promoted from embedded structs are on the same level as the fields of the embedding struct.
+	// 0 means unlimited.
+	MaxDepth int
+
+	// StrictTags causes Marshal to return an InvertedVersionRangeError for fields whose since version
+	// is greater than their until version, or whose between tag lists the greater version first.
+	// Such fields are never marshalled, so enabling it e.g. in tests catches mistakes in the tags.
+	StrictTags bool
+	// KnownGroups lists all valid groups. If it's set along with StrictTags, marshalling a field whose groups,
+	// groups_omitempty, groups_include or exclude_groups tag contains any other group returns an
+	// UnknownGroupError, which catches typos in group names. The wildcard group "*" is always valid.
+	KnownGroups []string
+	// StrictGroups causes marshalling to return an UnknownGroupError if a requested group, including
+	// DefaultGroups, isn't part of KnownGroups, e.g. because of a typo. The wildcard group "*" is always valid.
+	StrictGroups bool
+
+	// Channels, functions and unsafe pointers can't be encoded as JSON, so like with encoding/json, struct
+	// fields holding them are omitted and such elements of slices, arrays and maps are marshalled as nil.
+	// RejectUnsupported causes them to return a MarshalInvalidTypeError instead, so no data is dropped silently.
+	RejectUnsupported bool
+
+	// OnlyFields restricts the fields of the passed struct to those with the given names, while ExcludeFields
+	// removes the fields with the given names. The names are those of the json tag, i.e. before applying
+	// aliases and the KeyTransformer. Both only apply to the fields of the struct passed to Marshal, including
+	// fields promoted from embedded structs, but not to nested structs or the elements of a passed slice.
+	// Fields have to pass the group and version checks as well. If a name is in both, it's excluded.
+	OnlyFields    []string
+	ExcludeFields []string
+
+	// debugGroups records the group each field has been output for, see MarshalDebug.
+	debugGroups map[string]string
+	// releaseVersion is the release of a pre-release ApiVersion if ReleasePrecedence is set, which is
+	// computed once by resolveOptions.
+	releaseVersion *version.Version
+	// err is the first error of the With methods, which is returned when the options are used.
+	err error
 }
 
+// TimeFormatUnix is the time format outputting the seconds elapsed since January 1, 1970 UTC.
+const TimeFormatUnix = "unix"
+
+// CycleHandling determines how Marshal handles cyclic references.
+type CycleHandling int
+
+const (
+	// CycleError causes Marshal to return a CyclicReferenceError.
+	CycleError CycleHandling = iota
+	// CycleNil causes the cyclic reference to be marshalled as nil.
+	CycleNil
+)
+
+// contextCheckInterval is the number of slice elements or map entries after which the context is checked.
+const contextCheckInterval = 1000
+
 // MarshalInvalidTypeError is an error returned to indicate the wrong type has been
-// passed to Marshal.
+// passed to Marshal, or that a value like a channel or function can't be encoded as JSON with
+// Options.RejectUnsupported.
 type MarshalInvalidTypeError struct {
 	// t reflects the type of the data
 	t reflect.Kind
 	// data contains the passed data itself
 	data interface{}
+	// Path is the location of the data within the marshalled value, e.g. "User.Preferences[key]".
+	// It is empty if the passed value itself is invalid.
+	Path string
 }
 
 func (e MarshalInvalidTypeError) Error() string {
+	if isUnsupportedKind(e.t) {
+		if e.Path != "" {
+			return fmt.Sprintf("marshaller: Unable to marshal unsupported type %s. Path: %s", e.t, e.Path)
+		}
+		return fmt.Sprintf("marshaller: Unable to marshal unsupported type %s.", e.t)
+	}
+	if e.Path != "" {
+		return fmt.Sprintf("marshaller: Unable to marshal type %s. Struct required. Path: %s", e.t, e.Path)
+	}
 	return fmt.Sprintf("marshaller: Unable to marshal type %s. Struct required.", e.t)
 }
 
+// prefixErrorPath prepends prefix to the path of a MarshalInvalidTypeError while it's being
+// returned from nested values.
+func prefixErrorPath(err error, prefix string) error {
+	if e, ok := err.(MarshalInvalidTypeError); ok {
+		e.Path = prefix + e.Path
+		return e
+	}
+	return err
+}
+
+// CyclicReferenceError is an error returned to indicate a pointer references one of its parents.
+type CyclicReferenceError struct {
+	// t reflects the type of the pointer
+	t reflect.Type
+}
+
+func (e CyclicReferenceError) Error() string {
+	return fmt.Sprintf("marshaller: Unable to marshal cyclic reference of type %s.", e.t)
+}
+
+// UnknownTransformError is an error returned to indicate a field's transform tag refers to
+// a function missing in Options.FieldTransformers.
+type UnknownTransformError struct {
+	// Name is the value of the transform tag
+	Name string
+}
+
+func (e UnknownTransformError) Error() string {
+	return fmt.Sprintf("marshaller: Unknown field transformer %q.", e.Name)
+}
+
+// InvalidVersionTagError is an error returned to indicate the version of a field's since or until tag,
+// or the constraint of its version tag, can't be parsed.
+type InvalidVersionTagError struct {
+	// Field is the name of the struct type and field, e.g. "User.CreatedAt"
+	Field string
+	// Tag is the name of the tag, e.g. "since"
+	Tag string
+	// Err is the error returned by go-version
+	Err error
+}
+
+func (e InvalidVersionTagError) Error() string {
+	return fmt.Sprintf("marshaller: Invalid version in %s tag of field %s: %v", e.Tag, e.Field, e.Err)
+}
+
+// InvalidVersionRangeError is an error returned to indicate a field's between tag doesn't consist
+// of two comma-separated versions.
+type InvalidVersionRangeError struct {
+	// Value is the value of the between tag
+	Value string
+}
+
+func (e InvalidVersionRangeError) Error() string {
+	return fmt.Sprintf("marshaller: Invalid version range %q. Two comma-separated versions required.", e.Value)
+}
+
+// MaxDepthError is an error returned to indicate the marshalled data is nested deeper than Options.MaxDepth.
+type MaxDepthError struct {
+	// MaxDepth is the exceeded limit
+	MaxDepth int
+}
+
+func (e MaxDepthError) Error() string {
+	return fmt.Sprintf("marshaller: Maximum depth of %d exceeded.", e.MaxDepth)
+}
+
+// InvertedVersionRangeError is an error returned with Options.StrictTags to indicate a field is never
+// available because its since version is greater than its until version.
+type InvertedVersionRangeError struct {
+	// Field is the name of the struct type and field, e.g. "User.Email"
+	Field string
+	// Since and Until are the versions of the tags
+	Since, Until string
+}
+
+func (e InvertedVersionRangeError) Error() string {
+	return fmt.Sprintf("marshaller: Field %s is never available since version %s is greater than until version %s.", e.Field, e.Since, e.Until)
+}
+
+// UnknownGroupError is an error returned with Options.StrictTags to indicate a field's tag contains
+// a group which isn't part of Options.KnownGroups, or with Options.StrictGroups for a requested group.
+type UnknownGroupError struct {
+	// Field is the name of the struct type and field, e.g. "User.Email", or empty for a requested group
+	Field string
+	// Group is the unknown group
+	Group string
+}
+
+func (e UnknownGroupError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("marshaller: Requested group %s is unknown.", e.Group)
+	}
+	return fmt.Sprintf("marshaller: Field %s has unknown group %s.", e.Field, e.Group)
+}
+
 // Marshaller is the interface models have to implement in order to conform to marshalling.
 type Marshaller interface {
 	Marshal(options *Options) (interface{}, error)
 }
 
+// ContextMarshaller is like Marshaller, but additionally receives the state of marshalling at the value.
+// It takes precedence over Marshaller.
+type ContextMarshaller interface {
+	MarshalSheriff(mc MarshallerContext) (interface{}, error)
+}
+
+// FieldInfo describes a struct field passed to Options.FieldFilter.
+type FieldInfo struct {
+	// Context is the context passed to MarshalContext
+	Context context.Context
+	// Name is the key given by the field tag, i.e. before applying aliases and the KeyTransformer
+	Name string
+	// Field is the struct field, e.g. to look up its tags
+	Field reflect.StructField
+	// Parent is the struct value containing the field
+	Parent reflect.Value
+}
+
+// MarshallerContext is passed to a ContextMarshaller.
+type MarshallerContext struct {
+	// Context is the context passed to MarshalContext
+	Context context.Context
+	// Options are the options passed to Marshal
+	Options *Options
+	// Groups are the requested groups
+	Groups []string
+	// InheritedGroups are the groups passed on by the parents of the value, sorted by name,
+	// e.g. with Options.InheritGroups
+	InheritedGroups []string
+	// ApiVersion is the requested API version
+	ApiVersion *version.Version
+	// Path is the location of the value within the passed data, e.g. ".Items[2].Owner", using the names
+	// of struct fields and the keys of maps.
+	Path string
+}
+
+// ExposedFields can be implemented by structs in order to add fields to their output, e.g. to expose
+// unexported fields. The returned fields are added to the marshalled fields regardless of their groups
+// and versions and replace fields with the same key. Their keys are passed to the KeyTransformer and their values are
+// marshalled like the values of struct fields.
+// If SheriffFields has a pointer receiver, the struct has to be addressable, e.g. marshalled
+// through a pointer or as an element of a slice.
+type ExposedFields interface {
+	SheriffFields() map[string]interface{}
+}
+
 // Marshal encodes the passed data into a map which can be used to pass to json.Marshal().
 //
-// If the passed argument `data` is a struct, the return value will be of type `map[string]interface{}`.
+// If the passed argument `data` is a struct, the return value will be of type `map[string]interface{}`,
+// or OrderedMap if Options.PreserveOrder is set.
 // In all other cases we can't derive the type in a meaningful way and is therefore an `interface{}`.
+// Slices and arrays are marshalled into an `[]interface{}` of their marshalled elements, see MarshalSlice,
+// and maps into a `map[string]interface{}` of their marshalled values.
+//
+// Marshal doesn't modify the options and keeps its state per call, so it's safe for concurrent use with the
+// same Options as long as they aren't modified meanwhile, see Options.Clone.
 func Marshal(options *Options, data interface{}) (interface{}, error) {
+	return MarshalContext(context.Background(), options, data)
+}
+
+// MarshalContext encodes the passed data like Marshal does.
+//
+// The context is checked for every struct and every 1000 elements of a slice or array or entries of a map.
+// If it's done, marshalling stops and the context's error is returned, e.g. context.Canceled.
+func MarshalContext(ctx context.Context, options *Options, data interface{}) (interface{}, error) {
+	options, err := resolveOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRequireStruct(options, data); err != nil {
+		return nil, err
+	}
+
 	groups := make(groupSet)
 	groups.incrementGroups(options.Groups)
 	parents := make(groupSet)
-	return marshalObject(options, data, groups, parents, false)
+	visited := make(pointerSet)
+	path := &fieldPath{}
+	d, err := marshalObject(ctx, options, data, groups, parents, visited, path, 0, false)
+	if e, ok := err.(MarshalInvalidTypeError); ok && strings.HasPrefix(e.Path, ".") {
+		// start the path of a field with the name of the passed struct
+		t := reflect.TypeOf(data)
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		err = prefixErrorPath(err, t.Name())
+	}
+	return d, err
+}
+
+// MarshalJSON encodes the passed data using Marshal and returns its JSON encoding produced by json.Marshal().
+func MarshalJSON(options *Options, data interface{}) ([]byte, error) {
+	d, err := Marshal(options, data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(d)
+}
+
+// MarshalDebug encodes the passed data like Marshal does and additionally returns the group each field having
+// groups has been output for, which helps debugging the tags of complex models.
+//
+// The fields are identified by the name of their struct type and field, e.g. "User.Email", and the group is the
+// requested group which matched the field itself or was inherited from its parents. Of multiple matching groups,
+// the one listed first in Options.Groups is used. Fields output without a matching group, e.g. due to
+// OutputFieldsWithNoGroup or no requested groups at all, aren't included.
+func MarshalDebug(options *Options, data interface{}) (interface{}, map[string]string, error) {
+	o := *options
+	o.debugGroups = make(map[string]string)
+	d, err := Marshal(&o, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d, o.debugGroups, nil
+}
+
+// MarshalSlice encodes the passed slice or array, or a pointer to one, like Marshal does and returns the marshalled
+// elements, so callers can post-process them without a type assertion. Elements which are structs are of type
+// `map[string]interface{}`, or OrderedMap if Options.PreserveOrder is set.
+//
+// A MarshalInvalidTypeError is returned for any other data, as well as for slices which are left as is or marshal
+// themselves, e.g. []byte or types implementing Marshaller. Use Marshal for such data instead.
+func MarshalSlice(options *Options, data interface{}) ([]interface{}, error) {
+	v := reflect.ValueOf(data)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, MarshalInvalidTypeError{t: v.Kind(), data: data}
+	}
+	d, err := Marshal(options, data)
+	if err != nil || d == nil {
+		return nil, err
+	}
+	elems, ok := d.([]interface{})
+	if !ok {
+		return nil, MarshalInvalidTypeError{t: v.Kind(), data: data}
+	}
+	return elems, nil
 }
 
-func marshalObject(options *Options, data interface{}, groups, parents groupSet, embeddedParents bool) (interface{}, error) {
+// MarshalMap encodes the passed struct, or pointer to a struct, into a map like Marshal does, so callers can add or
+// remove keys without a type assertion. The map is returned even if Options.PreserveOrder is set.
+//
+// If `data` is not a struct, a MarshalInvalidTypeError is returned.
+func MarshalMap(options *Options, data interface{}) (map[string]interface{}, error) {
+	v := reflect.ValueOf(data)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, MarshalInvalidTypeError{t: v.Kind(), data: data}
+	}
+
+	d, err := Marshal(options, data)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := d.(OrderedMap); ok {
+		return m.Map(), nil
+	}
+	return d.(map[string]interface{}), nil
+}
+
+func marshalObject(ctx context.Context, options *Options, data interface{}, groups, parents groupSet, visited pointerSet, path *fieldPath, depth int, embeddedParents bool) (interface{}, error) {
 	v := reflect.ValueOf(data)
 	t := v.Type()
 
@@ -74,176 +518,925 @@ func marshalObject(options *Options, data interface{}, groups, parents groupSet,
 		t = t.Elem()
 	}
 	if v.Kind() == reflect.Ptr {
+		if !v.IsNil() {
+			if visited.contains(v) {
+				return marshalCycle(options, v.Type())
+			}
+			visited.add(v)
+			defer visited.remove(v)
+		}
 		// follow pointer
 		v = v.Elem()
 	}
 
 	if t.Kind() != reflect.Struct {
-		return marshalValue(options, v, groups, parents, false)
+		return marshalValue(ctx, options, v, groups, parents, visited, path, depth, false)
+	}
+	return marshalStruct(ctx, options, v, groups, parents, visited, path, depth, embeddedParents)
+}
+
+// marshalStruct marshals the struct v into a map[string]interface{}, or an OrderedMap if Options.PreserveOrder is set.
+// depth is the number of structs, slices, arrays and maps containing v.
+func marshalStruct(ctx context.Context, options *Options, v reflect.Value, groups, parents groupSet, visited pointerSet, path *fieldPath, depth int, embeddedParents bool) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := checkDepth(options, depth); err != nil {
+		return nil, err
+	}
+
+	if options.PreserveOrder {
+		var dest orderedMapBuilder
+		err := marshalFields(ctx, options, v, groups, parents, visited, path, depth+1, embeddedParents, func(name string, value interface{}) error {
+			dest.set(name, value)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if dest.m == nil {
+			return OrderedMap{}, nil
+		}
+		return dest.m, nil
 	}
 
 	dest := make(map[string]interface{})
+	err := marshalFields(ctx, options, v, groups, parents, visited, path, depth+1, embeddedParents, func(name string, value interface{}) error {
+		dest[name] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dest, nil
+}
 
-	for i := 0; i < t.NumField(); i++ {
-		field := t.Field(i)
-		val := v.Field(i)
+// resolveOptions returns the options used for marshalling, see withDefaultGroups, or an error of the With methods
+// or of a requested group which is unknown with StrictGroups.
+func resolveOptions(options *Options) (*Options, error) {
+	if options.err != nil {
+		return nil, options.err
+	}
+	options = withDefaultGroups(options)
+	if releaseVersion, err := comparedApiVersion(options); err != nil {
+		return nil, err
+	} else if releaseVersion != options.releaseVersion {
+		o := *options
+		o.releaseVersion = releaseVersion
+		options = &o
+	}
+	if options.StrictGroups {
+		for _, group := range options.Groups {
+			group = strings.TrimPrefix(group, excludedGroupPrefix)
+			if group != wildcardGroup && !contains(group, options.KnownGroups) {
+				return nil, UnknownGroupError{Group: group}
+			}
+		}
+	}
+	return options, nil
+}
+
+// withDefaultGroups returns options using DefaultGroups as Groups if no Groups are specified.
+func withDefaultGroups(options *Options) *Options {
+	if len(options.Groups) > 0 || len(options.DefaultGroups) == 0 {
+		return options
+	}
+	o := *options
+	o.Groups = o.DefaultGroups
+	return &o
+}
+
+// checkRequireStruct returns a MarshalInvalidTypeError if Options.RequireStruct is set and data isn't a struct or
+// a slice or array of structs.
+func checkRequireStruct(options *Options, data interface{}) error {
+	if options.RequireStruct && !isStructData(data) {
+		return MarshalInvalidTypeError{t: reflect.ValueOf(data).Kind(), data: data}
+	}
+	return nil
+}
 
-		jsonTag, jsonOpts := parseTag(field.Tag.Get("json"))
+// isStructData checks whether data is a struct or a slice or array of structs, or pointers to those.
+func isStructData(data interface{}) bool {
+	if data == nil {
+		return false
+	}
+	t := reflect.TypeOf(data)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+	}
+	return t.Kind() == reflect.Struct
+}
+
+// marshalFields marshals the fields of the struct v which should be output and passes each of them to emit.
+// The fields of embedded structs are passed individually. depth is the nesting depth of the fields.
+func marshalFields(ctx context.Context, options *Options, v reflect.Value, groups, parents groupSet, visited pointerSet, path *fieldPath, depth int, embeddedParents bool, emit func(name string, value interface{}) error) error {
+	structType := v.Type()
+	fields := cachedFields(options, structType)
+	// the struct is kept for the FieldFilter as v is shadowed by the marshalled values
+	parent := v
 
-		// If no json tag is provided, use the field Name
-		if jsonTag == "" {
-			jsonTag = field.Name
+	// fields replaced by ExposedFields are skipped, so they aren't written twice when encoding to a stream
+	exposed := exposedFields(options, v)
+	emitField := emit
+	if len(exposed) > 0 {
+		emitField = func(name string, value interface{}) error {
+			if _, ok := exposed[name]; ok {
+				return nil
+			}
+			return emit(name, value)
 		}
+	}
 
-		if jsonTag == "-" {
+	for i := range fields {
+		field := withGroupOverrides(options, &fields[i], structType, i)
+		val := v.Field(i)
+
+		if field.skip && !groups.containsAny(field.includeGroupNames) {
+			continue
+		}
+		if options.StrictTags {
+			if err := checkVersionRange(field, structType, i); err != nil {
+				return err
+			}
+			if err := checkKnownGroups(options, field, structType, i); err != nil {
+				return err
+			}
+		}
+		explicitOmitEmpty := field.jsonOpts.Contains("omitempty") || groups.containsAny(field.omitEmptyGroupNames)
+		omitEmpty := (options.OmitEmpty && !field.jsonOpts.Contains("keepempty")) || explicitOmitEmpty
+		if omitEmpty && (isEmptyValue(val) || isNilMarshaller(val) || (options.OmitEmptyDeep && isEmptyPointee(val))) {
 			continue
 		}
-		if jsonOpts.Contains("omitempty") && isEmptyValue(val) {
+		if options.OmitNilPointers && val.Kind() == reflect.Ptr && val.IsNil() {
 			continue
 		}
 		// skip unexported fields
 		if !val.IsValid() || !val.CanInterface() {
 			continue
 		}
+		if !options.RejectUnsupported && isUnsupportedKind(val.Kind()) {
+			continue
+		}
 
 		// if there is an anonymous field which is a struct
 		// we want the childs exposed at the toplevel to be
-		// consistent with the embedded json marshaller
+		// consistent with the embedded json marshaller.
+		// Pointers are remembered in order to detect cyclic references.
+		var ptr reflect.Value
 		if val.Kind() == reflect.Ptr {
+			// like encoding/json, a nil pointer to an embedded struct provides no fields
+			if val.IsNil() && field.anonymous && val.Type().Elem().Kind() == reflect.Struct {
+				continue
+			}
+			if !val.IsNil() {
+				ptr = val
+			}
 			val = val.Elem()
 		}
 
 		// we can skip the group checkif if the field is a composition field
-		isEmbeddedField := field.Anonymous && val.Kind() == reflect.Struct
-		var groupNames []string
-		checkGroups := len(options.Groups) > 0 || (options.InheritGroups && len(parents) > 0) || options.OutputFieldsWithNoGroup
-		shouldShowFromGroup := true
-		if checkGroups {
-			if field.Tag.Get("groups") != "" {
-				groupNames = strings.Split(field.Tag.Get("groups"), ",")
+		isEmbeddedField := field.anonymous && (val.Kind() == reflect.Struct || holdsStruct(val))
+		// unlike with encoding/json, an embedded struct of zero values with omitempty provides no fields.
+		// With Options.OmitEmpty its promoted fields are omitted individually instead, so keepempty applies.
+		if isEmbeddedField && explicitOmitEmpty && isZeroStruct(val) {
+			continue
+		}
+		shouldShow, parentGroups, err := shouldMarshalField(options, field, isEmbeddedField, groups, parents, embeddedParents)
+		if err != nil {
+			return err
+		}
+		if depth == 1 && !isEmbeddedField && !isFieldSelected(options, field.name) {
+			continue
+		}
+		// hidden fields aren't marshalled at all, so their values can't cause errors
+		if !shouldShow {
+			continue
+		}
+		if !isEmbeddedField && field.shadowedNames[field.name] {
+			continue
+		}
+		if !isEmbeddedField && options.FieldFilter != nil &&
+			!options.FieldFilter(FieldInfo{Context: ctx, Name: field.name, Field: structType.Field(i), Parent: parent}) {
+			continue
+		}
+
+		childParents := enterField(options, parents, parentGroups, isEmbeddedField)
+		var v interface{}
+		if ptr.IsValid() && visited.contains(ptr) {
+			v, err = marshalCycle(options, ptr.Type())
+		} else {
+			if ptr.IsValid() {
+				visited.add(ptr)
+			}
+			fieldDepth := depth
+			if isEmbeddedField {
+				// promoted fields are on the same level as the fields of the embedding struct
+				fieldDepth--
 			}
-			hasExactMatch := groups.containsAny(groupNames)
-			hasParentMatch := false
-			if options.InheritGroups {
-				hasParentMatch = parents.containsAny(options.Groups)
-			} else if embeddedParents && len(groupNames) == 0 {
-				hasParentMatch = parents.containsAny(options.Groups)
+			path.pushField(structType.Field(i).Name)
+			v, err = marshalValue(ctx, options, val, groups, childParents, visited, path, fieldDepth, isEmbeddedField)
+			path.pop()
+			err = prefixErrorPath(err, "."+structType.Field(i).Name)
+			if ptr.IsValid() {
+				visited.remove(ptr)
 			}
-			hasNoGroup := (len(groupNames) == 0)
-			shouldShowFromGroup = hasExactMatch || hasParentMatch || (hasNoGroup && options.OutputFieldsWithNoGroup) || isEmbeddedField
 		}
-
-		shouldShowFromSince := true
-		if since := field.Tag.Get("since"); since != "" {
-			sinceVersion, err := version.NewVersion(since)
-			if err != nil {
-				return nil, err
+		leaveField(options, parents, parentGroups, isEmbeddedField)
+		if err != nil {
+			return err
+		}
+		nestedVal, ok := marshalledEntries(v)
+		if isEmbeddedField && ok {
+			for _, kv := range nestedVal {
+				if isShadowed(options, field, kv.Key) {
+					continue
+				}
+				if err := emitField(kv.Key, kv.Value); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if field.shadowedNames[field.name] {
+			continue
+		}
+		// structs whose fields have all been omitted are considered empty too
+		if m, ok := marshalledEntries(v); ok && len(m) == 0 && omitEmpty {
+			continue
+		}
+		if field.timeFormat != "" && val.IsValid() {
+			if t, ok := val.Interface().(time.Time); ok {
+				v = formatTime(options, t, field.timeFormat)
 			}
-			if options.ApiVersion.LessThan(sinceVersion) {
-				shouldShowFromSince = false
+		}
+		if field.transform != "" {
+			transform, ok := options.FieldTransformers[field.transform]
+			if !ok {
+				return UnknownTransformError{Name: field.transform}
 			}
+			v = transform(v)
 		}
-
-		shouldShowFromUntil := true
-		if until := field.Tag.Get("until"); until != "" {
-			untilVersion, err := version.NewVersion(until)
+		if field.quoted && v != nil {
+			b, err := json.Marshal(v)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			if options.ApiVersion.GreaterThan(untilVersion) {
-				shouldShowFromUntil = false
+			v = string(b)
+		}
+		if options.debugGroups != nil {
+			if group := matchedGroup(options, field, groups, parents); group != "" {
+				options.debugGroups[structType.Name()+"."+structType.Field(i).Name] = group
 			}
 		}
+		if err := emitField(fieldName(options, field), v); err != nil {
+			return err
+		}
+	}
+
+	return marshalExposedFields(ctx, options, exposed, groups, parents, visited, path, depth, emit)
+}
 
-		if options.InheritGroups || isEmbeddedField {
-			parents.incrementGroups(groupNames)
+// exposedFields returns the fields of the struct v if it implements ExposedFields, keyed like the names of
+// struct fields, i.e. after applying the KeyTransformer.
+func exposedFields(options *Options, v reflect.Value) map[string]interface{} {
+	if v.CanAddr() {
+		v = v.Addr()
+	}
+	if !v.CanInterface() {
+		return nil
+	}
+	exposed, ok := v.Interface().(ExposedFields)
+	if !ok {
+		return nil
+	}
+	fields := exposed.SheriffFields()
+	if options.KeyTransformer == nil {
+		return fields
+	}
+	transformed := make(map[string]interface{}, len(fields))
+	for k, value := range fields {
+		transformed[options.KeyTransformer(k)] = value
+	}
+	return transformed
+}
+
+// marshalExposedFields emits the fields returned by exposedFields, sorted by their keys. The values are
+// marshalled like the values of struct fields.
+func marshalExposedFields(ctx context.Context, options *Options, fields map[string]interface{}, groups, parents groupSet, visited pointerSet, path *fieldPath, depth int, emit func(name string, value interface{}) error) error {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		path.pushField(k)
+		d, err := marshalValue(ctx, options, reflect.ValueOf(fields[k]), groups, parents, visited, path, depth, false)
+		path.pop()
+		if err != nil {
+			return prefixErrorPath(err, "."+k)
 		}
-		v, err := marshalValue(options, val, groups, parents, isEmbeddedField)
-		if options.InheritGroups || isEmbeddedField {
-			parents.decrementGroups(groupNames)
+		if err := emit(k, d); err != nil {
+			return err
 		}
-		if err != nil {
-			return nil, err
+	}
+	return nil
+}
+
+// matchedGroup returns the requested group a field has been output for, or an empty string for fields output
+// regardless of their groups.
+func matchedGroup(options *Options, field *fieldInfo, groups, parents groupSet) string {
+	groupNames := field.groupNames
+	if len(groupNames) == 0 && len(field.negatedGroupNames) == 0 && options.DefaultGroup != "" {
+		groupNames = []string{options.DefaultGroup}
+	}
+	if groups.contains(wildcardGroup) && len(groupNames) > 0 {
+		return wildcardGroup
+	}
+	for _, group := range options.Groups {
+		if contains(group, groupNames) {
+			return group
 		}
-		if shouldShowFromGroup && shouldShowFromSince && shouldShowFromUntil {
-			nestedVal, ok := v.(map[string]interface{})
-			if isEmbeddedField && ok {
-				for k, v := range nestedVal {
-					dest[k] = v
-				}
-			} else {
-				dest[jsonTag] = v
+	}
+	if contains(wildcardGroup, groupNames) {
+		return wildcardGroup
+	}
+	for _, group := range options.Groups {
+		if parents.contains(group) {
+			return group
+		}
+	}
+	return ""
+}
+
+// isFieldSelected checks whether a field of the passed struct named name is selected by
+// Options.OnlyFields and Options.ExcludeFields.
+func isFieldSelected(options *Options, name string) bool {
+	if contains(name, options.ExcludeFields) {
+		return false
+	}
+	return len(options.OnlyFields) == 0 || contains(name, options.OnlyFields)
+}
+
+// fieldName returns the key of a field in the output map.
+//
+// If the field has an alias for one of the requested groups, the alias of the group listed first
+// in the options is used. Otherwise it's the name given by the json tag.
+// Either is passed to the KeyTransformer, if set.
+func fieldName(options *Options, field *fieldInfo) string {
+	name := field.name
+	for _, group := range options.Groups {
+		if alias, ok := field.aliases[group]; ok {
+			name = alias
+			break
+		}
+	}
+	if options.KeyTransformer != nil {
+		return options.KeyTransformer(name)
+	}
+	return name
+}
+
+// isShadowed checks whether the key of a field promoted from the embedded field is hidden by
+// another field. As the key has been passed to fieldName, so are the shadowed names.
+func isShadowed(options *Options, field *fieldInfo, key string) bool {
+	if options.KeyTransformer == nil {
+		return field.shadowedNames[key]
+	}
+	for name := range field.shadowedNames {
+		if options.KeyTransformer(name) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// enterField passes on the groups of a field to the parents of the fields of its value and returns those parents.
+// leaveField has to be called once the value has been processed.
+func enterField(options *Options, parents groupSet, parentGroups []string, isEmbeddedField bool) groupSet {
+	if options.InheritGroups && options.MaxInheritDepth > 0 {
+		return parents.descend(parentGroups, options.MaxInheritDepth, isEmbeddedField)
+	}
+	if options.InheritGroups || isEmbeddedField {
+		parents.incrementGroups(parentGroups)
+	}
+	return parents
+}
+
+// leaveField reverts passing on the groups of a field by enterField.
+func leaveField(options *Options, parents groupSet, parentGroups []string, isEmbeddedField bool) {
+	if options.InheritGroups && options.MaxInheritDepth > 0 {
+		return
+	}
+	if options.InheritGroups || isEmbeddedField {
+		parents.decrementGroups(parentGroups)
+	}
+}
+
+// shouldMarshalField evaluates the groups, since and until tags of a struct field.
+// It returns whether the field should be marshalled and which of its groups are
+// passed on to the parents of its children.
+func shouldMarshalField(options *Options, field *fieldInfo, isEmbeddedField bool, groups, parents groupSet, embeddedParents bool) (bool, []string, error) {
+	var groupNames, negatedGroupNames []string
+	checkGroups := len(options.Groups) > 0 || (options.InheritGroups && len(parents) > 0) || options.OutputFieldsWithNoGroup
+	// fields without tags are output regardless of their parents and versions unless
+	// they are assigned to a group
+	if !field.tagged && (!checkGroups || (options.OutputFieldsWithNoGroup && options.DefaultGroup == "")) {
+		return true, nil, nil
+	}
+	shouldShowFromGroup := true
+	if checkGroups {
+		groupNames, negatedGroupNames = field.groupNames, field.negatedGroupNames
+		if len(groupNames) == 0 && len(negatedGroupNames) == 0 && options.DefaultGroup != "" {
+			groupNames = []string{options.DefaultGroup}
+		}
+		// additive groups of the parents apply in addition to the field's own groups
+		ownGroupNames := groupNames
+		if additive := parents.additiveGroups(); len(additive) > 0 {
+			groupNames = append(append([]string(nil), groupNames...), additive...)
+		}
+		hasWildcard := groups.contains(wildcardGroup)
+		// a field having the group "*" matches any requested groups, even none
+		hasWildcardGroup := contains(wildcardGroup, groupNames)
+		var hasExactMatch bool
+		if hasWildcard || hasWildcardGroup {
+			hasExactMatch = len(groupNames) > 0
+		} else if options.MatchAllGroups {
+			hasExactMatch = groups.containsAll(groupNames)
+		} else {
+			hasExactMatch = groups.containsAny(groupNames)
+		}
+		hasParentMatch := false
+		if options.InheritGroups || (embeddedParents && len(ownGroupNames) == 0) {
+			hasParentMatch = parents.containsAny(options.Groups) || parents.contains(wildcardGroup) ||
+				(hasWildcard && parents.containsAnyGroup())
+		}
+		// a negated or excluded group always takes precedence over any positive match
+		hasNegatedMatch := groups.containsAny(negatedGroupNames) || groups.containsAny(field.excludedGroupNames) ||
+			groups.containsAnyExcluded(groupNames)
+		hasOnlyNegatedGroups := len(ownGroupNames) == 0 && len(negatedGroupNames) > 0
+		hasNoGroup := len(ownGroupNames) == 0 && len(negatedGroupNames) == 0
+		shouldShowFromGroup = !hasNegatedMatch &&
+			(hasExactMatch || hasParentMatch || hasOnlyNegatedGroups || (hasNoGroup && options.OutputFieldsWithNoGroup) || isEmbeddedField)
+	}
+
+	shouldShowFromVersion, err := shouldMarshalVersion(options, field, groups)
+	if err != nil {
+		return false, nil, err
+	}
+
+	// with MatchAllGroups, a partially matching parent must not pass on its groups
+	parentGroups := groupNames
+	if options.MatchAllGroups && !groups.contains(wildcardGroup) && !contains(wildcardGroup, groupNames) &&
+		!groups.containsAll(groupNames) {
+		parentGroups = nil
+	}
+	if len(field.additiveGroupNames) > 0 {
+		parentGroups = append(append([]string(nil), parentGroups...), markAdditive(field.additiveGroupNames)...)
+	}
+	return shouldShowFromGroup && shouldShowFromVersion, parentGroups, nil
+}
+
+// shouldMarshalVersion evaluates the version, since and until tags of a struct field.
+// Entries of the version tag scoped to a group only apply if that group is requested.
+func shouldMarshalVersion(options *Options, field *fieldInfo, groups groupSet) (bool, error) {
+	// version filtering is disabled if no API version has been specified
+	if options.ApiVersion == nil {
+		return true, nil
+	}
+	apiVersion := options.ApiVersion
+	if options.releaseVersion != nil {
+		apiVersion = options.releaseVersion
+	}
+
+	// the version tag takes precedence over since and until
+	if field.versionErr != nil {
+		return false, field.versionErr
+	}
+	if field.groupVersionConstraints != nil {
+		matched := false
+		for group, constraints := range field.groupVersionConstraints {
+			if !groups.contains(group) && !groups.contains(wildcardGroup) {
+				continue
+			}
+			matched = true
+			if checkVersionConstraints(constraints, apiVersion) {
+				return true, nil
 			}
 		}
+		if matched {
+			return false, nil
+		}
+	}
+	if field.versionConstraints != nil {
+		return checkVersionConstraints(field.versionConstraints, apiVersion), nil
 	}
 
-	return dest, nil
+	if field.sinceErr != nil {
+		return false, field.sinceErr
+	}
+	if field.sinceVersion != nil && apiVersion.LessThan(field.sinceVersion) {
+		return false, nil
+	}
+
+	if field.untilErr != nil {
+		return false, field.untilErr
+	}
+	if field.untilVersion != nil && apiVersion.GreaterThan(field.untilVersion) {
+		return false, nil
+	}
+
+	// the between tag has to be satisfied in addition to since and until
+	if field.betweenErr != nil {
+		return false, field.betweenErr
+	}
+	if field.betweenVersions[0] != nil &&
+		(apiVersion.LessThan(field.betweenVersions[0]) || apiVersion.GreaterThan(field.betweenVersions[1])) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// checkVersionRange returns an InvertedVersionRangeError if the since and until or between tags of the i-th field
+// of structType exclude every version.
+func checkVersionRange(field *fieldInfo, structType reflect.Type, i int) error {
+	ranges := [][2]*version.Version{{field.sinceVersion, field.untilVersion}, field.betweenVersions}
+	for _, r := range ranges {
+		if r[0] != nil && r[1] != nil && r[0].GreaterThan(r[1]) {
+			return InvertedVersionRangeError{
+				Field: structType.Name() + "." + structType.Field(i).Name,
+				Since: r[0].Original(),
+				Until: r[1].Original(),
+			}
+		}
+	}
+	return nil
+}
+
+// withGroupOverrides returns the i-th field of structType with the groups of options.FieldGroupOverrides added.
+// The cached field is returned as is if there are none, otherwise a copy is returned.
+func withGroupOverrides(options *Options, field *fieldInfo, structType reflect.Type, i int) *fieldInfo {
+	if len(options.FieldGroupOverrides) == 0 {
+		return field
+	}
+	overrides, ok := options.FieldGroupOverrides[structType.Name()+"."+structType.Field(i).Name]
+	if !ok {
+		return field
+	}
+	groupNames, negatedGroupNames := splitNegatedGroups(overrides)
+	f := *field
+	f.groupNames = append(append([]string(nil), field.groupNames...), groupNames...)
+	f.negatedGroupNames = append(append([]string(nil), field.negatedGroupNames...), negatedGroupNames...)
+	f.tagged = true
+	return &f
+}
+
+// checkKnownGroups returns an UnknownGroupError if the group tags of the i-th field of structType contain
+// a group which isn't part of options.KnownGroups. Nothing is checked if KnownGroups is empty.
+func checkKnownGroups(options *Options, field *fieldInfo, structType reflect.Type, i int) error {
+	if len(options.KnownGroups) == 0 {
+		return nil
+	}
+	for _, names := range [][]string{field.groupNames, field.negatedGroupNames, field.excludedGroupNames} {
+		for _, name := range names {
+			if name != wildcardGroup && !contains(name, options.KnownGroups) {
+				return UnknownGroupError{Field: structType.Name() + "." + structType.Field(i).Name, Group: name}
+			}
+		}
+	}
+	return nil
+}
+
+// holdsStruct checks whether v is an interface holding a struct or a non-nil pointer to a struct.
+// Like embedded structs, the fields of such an embedded interface are promoted to the embedding struct.
+// As the promoted fields depend on the dynamic type, they aren't subject to the rules for shadowing names.
+func holdsStruct(v reflect.Value) bool {
+	if v.Kind() != reflect.Interface || v.IsNil() {
+		return false
+	}
+	e := v.Elem()
+	if e.Kind() == reflect.Ptr && !e.IsNil() {
+		e = e.Elem()
+	}
+	return e.Kind() == reflect.Struct
+}
+
+// formatTime formats t using layout after converting it to options.TimeLocation, if set.
+// For TimeFormatUnix, the Unix time is returned as an int64.
+func formatTime(options *Options, t time.Time, layout string) interface{} {
+	if options.TimeLocation != nil {
+		t = t.In(options.TimeLocation)
+	}
+	if layout == TimeFormatUnix {
+		return t.Unix()
+	}
+	return t.Format(layout)
+}
+
+// isNilMarshaller checks whether v is an interface holding a nil pointer which marshals itself,
+// i.e. implements Marshaller, ContextMarshaller, json.Marshaler or encoding.TextMarshaler.
+// Such a value is considered empty although the interface itself isn't nil.
+func isNilMarshaller(v reflect.Value) bool {
+	if v.Kind() != reflect.Interface || v.IsNil() {
+		return false
+	}
+	e := v.Elem()
+	if e.Kind() != reflect.Ptr || !e.IsNil() {
+		return false
+	}
+	t := e.Type()
+	return t.Implements(marshallerType) || t.Implements(contextMarshallerType) ||
+		t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType)
+}
+
+// isZeroStruct checks whether v is a struct all of whose fields have their zero value.
+func isZeroStruct(v reflect.Value) bool {
+	return v.Kind() == reflect.Struct && reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// isEmptyPointee checks whether v is a non-nil pointer to an empty value, following pointers to pointers.
+func isEmptyPointee(v reflect.Value) bool {
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+		if isEmptyValue(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkVersionConstraints checks whether v satisfies any of the alternative constraints.
+func checkVersionConstraints(alternatives []version.Constraints, v *version.Version) bool {
+	for _, c := range alternatives {
+		if c.Check(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// comparedApiVersion returns the release of a pre-release ApiVersion if ReleasePrecedence is set, which the
+// versions of fields are compared with instead of ApiVersion, or nil otherwise.
+func comparedApiVersion(options *Options) (*version.Version, error) {
+	if !options.ReleasePrecedence || options.ApiVersion == nil || options.ApiVersion.Prerelease() == "" {
+		return nil, nil
+	}
+	segments := options.ApiVersion.Segments64()
+	release := make([]string, len(segments))
+	for i, segment := range segments {
+		release[i] = strconv.FormatInt(segment, 10)
+	}
+	return version.NewVersion(strings.Join(release, "."))
 }
 
 // marshalValue is being used for getting the actual value of a field.
 //
-// There is support for types implementing the Marshaller interface, arbitrary structs, slices, maps and base types.
-func marshalValue(options *Options, v reflect.Value, groups, parents groupSet, embeddedParents bool) (interface{}, error) {
+// There is support for types implementing the Marshaller interface, arbitrary structs, slices, arrays, maps and base types.
+// depth is the number of structs, slices, arrays and maps containing v.
+func marshalValue(ctx context.Context, options *Options, v reflect.Value, groups, parents groupSet, visited pointerSet, path *fieldPath, depth int, embeddedParents bool) (interface{}, error) {
 	// return nil on nil pointer struct fields
 	if !v.IsValid() || !v.CanInterface() {
 		return nil, nil
 	}
 	val := v.Interface()
 
+	if marshaller, ok := val.(ContextMarshaller); ok {
+		return marshaller.MarshalSheriff(MarshallerContext{
+			Context:         ctx,
+			Options:         options,
+			Groups:          options.Groups,
+			InheritedGroups: parents.groups(),
+			ApiVersion:      options.ApiVersion,
+			Path:            path.String(),
+		})
+	}
 	if marshaller, ok := val.(Marshaller); ok {
 		return marshaller.Marshal(options)
 	}
-	// types which are e.g. structs, slices or maps and implement one of the following interfaces should not be
-	// marshalled by sheriff because they'll be correctly marshalled by json.Marshal instead.
-	// Otherwise (e.g. net.IP) a byte slice may be output as a list of uints instead of as an IP string.
-	switch val.(type) {
-	case json.Marshaler, encoding.TextMarshaler, fmt.Stringer, []byte:
+	if options.TimeFormat != "" {
+		if t, ok := val.(time.Time); ok {
+			return formatTime(options, t, options.TimeFormat), nil
+		}
+		if t, ok := val.(*time.Time); ok && t != nil {
+			return formatTime(options, *t, options.TimeFormat), nil
+		}
+	}
+	if marshaler, ok := binaryMarshaler(val); ok {
+		if rv := reflect.ValueOf(val); rv.Kind() == reflect.Ptr && rv.IsNil() {
+			return nil, nil
+		}
+		b, err := marshaler.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.EncodeToString(b), nil
+	}
+	if marshalledByJSON(options, val) {
 		return val, nil
 	}
 	k := v.Kind()
 
+	// nil pointers and interfaces, e.g. of slice elements, are marshalled as nil
+	if (k == reflect.Ptr || k == reflect.Interface) && v.IsNil() {
+		return nil, nil
+	}
 	if k == reflect.Ptr {
+		if visited.contains(v) {
+			return marshalCycle(options, v.Type())
+		}
+		visited.add(v)
+		defer visited.remove(v)
 		v = v.Elem()
 		val = v.Interface()
 		k = v.Kind()
 	}
 
-	if k == reflect.Interface || k == reflect.Struct {
-		return marshalObject(options, val, groups, parents, embeddedParents)
+	if k == reflect.Ptr {
+		// follow multiple indirections like encoding/json does, e.g. of a **T
+		return marshalValue(ctx, options, v, groups, parents, visited, path, depth, embeddedParents)
+	}
+
+	if k == reflect.Interface {
+		return marshalObject(ctx, options, val, groups, parents, visited, path, depth, embeddedParents)
+	}
+	if k == reflect.Struct {
+		return marshalStruct(ctx, options, v, groups, parents, visited, path, depth, embeddedParents)
+	}
+	if k == reflect.Slice && v.IsNil() {
+		return nil, nil
 	}
-	if k == reflect.Slice {
+	if k == reflect.Slice || k == reflect.Array {
+		if err := checkDepth(options, depth); err != nil {
+			return nil, err
+		}
 		l := v.Len()
 		dest := make([]interface{}, l)
 		for i := 0; i < l; i++ {
-			d, err := marshalValue(options, v.Index(i), groups, parents, embeddedParents)
+			if i%contextCheckInterval == 0 {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+			}
+			path.pushIndex(i)
+			d, err := marshalValue(ctx, options, v.Index(i), groups, parents, visited, path, depth+1, embeddedParents)
+			path.pop()
 			if err != nil {
-				return nil, err
+				return nil, prefixErrorPath(err, "["+strconv.Itoa(i)+"]")
 			}
 			dest[i] = d
 		}
+		if options.FlattenSingleElementSlices && l == 1 && depth > 0 {
+			return dest[0], nil
+		}
 		return dest, nil
 	}
 	if k == reflect.Map {
-		mapKeys := v.MapKeys()
-		if len(mapKeys) == 0 {
+		if v.IsNil() {
 			return nil, nil
 		}
-		if mapKeys[0].Kind() != reflect.String {
-			return nil, MarshalInvalidTypeError{t: mapKeys[0].Kind(), data: val}
+		if err := checkDepth(options, depth); err != nil {
+			return nil, err
+		}
+		if options.MapKeyFunc == nil && !isValidMapKey(v.Type().Key()) {
+			return nil, MarshalInvalidTypeError{t: v.Type().Key().Kind(), data: val}
 		}
+		mapKeys := v.MapKeys()
 		dest := make(map[string]interface{})
-		for _, key := range mapKeys {
-			d, err := marshalValue(options, v.MapIndex(key), groups, parents, embeddedParents)
+		for i, key := range mapKeys {
+			if i%contextCheckInterval == 0 {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+			}
+			name, err := mapKeyName(options, key)
 			if err != nil {
 				return nil, err
 			}
-			dest[key.Interface().(string)] = d
+			path.pushKey(name)
+			d, err := marshalValue(ctx, options, v.MapIndex(key), groups, parents, visited, path, depth+1, embeddedParents)
+			path.pop()
+			if err != nil {
+				return nil, prefixErrorPath(err, "["+name+"]")
+			}
+			dest[name] = d
 		}
 		return dest, nil
 	}
+	if isUnsupportedKind(k) {
+		if !options.RejectUnsupported {
+			return nil, nil
+		}
+		return nil, MarshalInvalidTypeError{t: k, data: val}
+	}
 	return val, nil
 }
 
+// isUnsupportedKind checks whether values of kind k can't be encoded as JSON.
+func isUnsupportedKind(k reflect.Kind) bool {
+	return k == reflect.Chan || k == reflect.Func || k == reflect.UnsafePointer
+}
+
+// isValidMapKey checks whether a map key type is supported, which are the same types encoding/json supports:
+// strings, integers and types implementing encoding.TextMarshaler, as well as types implementing fmt.Stringer.
+func isValidMapKey(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return t.Implements(textMarshalerType) || t.Implements(stringerType)
+}
+
+// mapKeyName returns the key in the output map for a map key using Options.MapKeyFunc, if set,
+// or the same way encoding/json does.
+func mapKeyName(options *Options, k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if options.MapKeyFunc != nil {
+		return options.MapKeyFunc(k)
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
+		}
+		b, err := tm.MarshalText()
+		return string(b), err
+	}
+	// unlike encoding/json, other key types implementing fmt.Stringer are supported as well
+	if s, ok := k.Interface().(fmt.Stringer); ok {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
+		}
+		return s.String(), nil
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", MarshalInvalidTypeError{t: k.Kind(), data: k.Interface()}
+}
+
+// checkDepth returns a MaxDepthError if a struct, slice, array or map contained in depth others exceeds Options.MaxDepth.
+func checkDepth(options *Options, depth int) error {
+	if options.MaxDepth > 0 && depth >= options.MaxDepth {
+		return MaxDepthError{MaxDepth: options.MaxDepth}
+	}
+	return nil
+}
+
+// marshalCycle returns the result of marshalling a cyclic reference to a value of type t.
+func marshalCycle(options *Options, t reflect.Type) (interface{}, error) {
+	if options.OnCycle == CycleNil {
+		return nil, nil
+	}
+	return nil, CyclicReferenceError{t: t}
+}
+
+// marshalledBySelf checks whether a value implements Marshaller or ContextMarshaller.
+func marshalledBySelf(val interface{}) bool {
+	switch val.(type) {
+	case Marshaller, ContextMarshaller:
+		return true
+	}
+	return false
+}
+
+// binaryMarshaler returns val if it implements encoding.BinaryMarshaler but neither json.Marshaler nor
+// encoding.TextMarshaler, which encoding/json would use instead. Otherwise encoding/json would output the
+// fields of such a value, so its binary encoding is output as a base64 string like a []byte instead.
+func binaryMarshaler(val interface{}) (encoding.BinaryMarshaler, bool) {
+	switch val.(type) {
+	case json.Marshaler, encoding.TextMarshaler:
+		return nil, false
+	}
+	marshaler, ok := val.(encoding.BinaryMarshaler)
+	return marshaler, ok
+}
+
+// marshalledByJSON checks whether a value is left as is in order to be marshalled by json.Marshal.
+//
+// Types which are e.g. structs, slices or maps and implement one of the following interfaces should not be
+// marshalled by sheriff because they'll be correctly marshalled by json.Marshal instead.
+// Otherwise (e.g. net.IP) a byte slice may be output as a list of uints instead of as an IP string.
+func marshalledByJSON(options *Options, val interface{}) bool {
+	switch val.(type) {
+	case json.Marshaler, encoding.TextMarshaler, encoding.BinaryMarshaler, []byte:
+		return true
+	case fmt.Stringer:
+		return !options.IgnoreStringer
+	}
+	return false
+}
+
 // contains check if a given key is contained in a slice of strings.
 func contains(key string, list []string) bool {
 	for _, innerKey := range list {
@@ -1,8 +1,16 @@
 package sheriff
 
 import (
+	"bytes"
+	"context"
+	"encoding"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -284,6 +292,36 @@ func TestMarshal_Versions(t *testing.T) {
 	assert.JSONEq(t, string(expected), string(actual))
 }
 
+func TestMarshal_VersionsNoApiVersion(t *testing.T) {
+	testModel := &TestVersionsModel{
+		DefaultMarshal: "DefaultMarshal",
+		NeverMarshal:   "NeverMarshal",
+		Until20:        "Until20",
+		Until21:        "Until21",
+		Since20:        "Since20",
+		Since21:        "Since21",
+	}
+
+	o := &Options{}
+
+	actualMap, err := Marshal(o, testModel)
+	assert.NoError(t, err)
+
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+
+	expected, err := json.Marshal(map[string]string{
+		"default_marshal": "DefaultMarshal",
+		"until_20":        "Until20",
+		"until_21":        "Until21",
+		"since_20":        "Since20",
+		"since_21":        "Since21",
+	})
+	assert.NoError(t, err)
+
+	assert.JSONEq(t, string(expected), string(actual))
+}
+
 type IsMarshaller struct {
 	ShouldMarshal string `json:"should_marshal" groups:"test"`
 }
@@ -476,9 +514,22 @@ func TestMarshal_EmptyMap(t *testing.T) {
 	actual, err := json.Marshal(actualMap)
 	assert.NoError(t, err)
 
-	expected, err := json.Marshal(map[string]interface{}{
-		"a_map": nil,
-	})
+	expected, err := json.Marshal(emp)
+	assert.NoError(t, err)
+
+	assert.JSONEq(t, string(expected), string(actual))
+}
+
+func TestMarshal_NilMap(t *testing.T) {
+	emp := EmptyMapTest{}
+	o := &Options{
+		Groups: []string{"test"},
+	}
+
+	actual, err := MarshalJSON(o, emp)
+	assert.NoError(t, err)
+
+	expected, err := json.Marshal(emp)
 	assert.NoError(t, err)
 
 	assert.JSONEq(t, string(expected), string(actual))
@@ -515,6 +566,29 @@ func TestMarshal_EmbeddedField(t *testing.T) {
 	assert.JSONEq(t, string(expected), string(actual))
 }
 
+func TestMarshal_EmbeddedFieldNil(t *testing.T) {
+	v := TestMarshal_EmbeddedParent{nil, "World"}
+
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"test"}}, `{"bar":"World"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"test"}, OutputFieldsWithNoGroup: true}, `{"bar":"World"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"test"}, PreserveOrder: true}, `{"bar":"World"}`)
+
+	// without groups, the output matches encoding/json, which omits nil embedded pointers as well
+	expected, err := json.Marshal(v)
+	assert.NoError(t, err)
+	verifyOutputGivenOptions(t, v, &Options{}, string(expected))
+
+	var buf bytes.Buffer
+	assert.NoError(t, NewEncoder(&buf, &Options{}).Encode(v))
+	assert.JSONEq(t, string(expected), buf.String())
+
+	v.TestMarshal_Embedded = &TestMarshal_Embedded{"Hello"}
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"test"}, PreserveOrder: true}, `{"foo":"Hello","bar":"World"}`)
+	expected, err = json.Marshal(v)
+	assert.NoError(t, err)
+	verifyOutputGivenOptions(t, v, &Options{}, string(expected))
+}
+
 type TestMarshal_EmbeddedEmpty struct {
 	Foo string
 }
@@ -763,6 +837,12 @@ func TestInheritMarshaling(t *testing.T) {
 	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"parent"}, InheritGroups: true}, expectedInheritParent)
 	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"parent", "mid"}, InheritGroups: true, OutputFieldsWithNoGroup: true}, expectedInheritParentMidIgnore)
 	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"leaf"}, InheritGroups: true, OutputFieldsWithNoGroup: true}, expectedInheritLeafIgnore)
+
+	expectedInheritParentDepth1 := `{"TaggedInParent":{"TaggedInMid":{},"UntaggedInMid":{}}}`
+	expectedInheritParentMidDepth1 := `{"TaggedInParent":{"TaggedInMid":{"TaggedInLeaf":"parentmidleaf","UntaggedInLeaf":"parentmid_"},"UntaggedInMid":{}}}`
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"parent"}, InheritGroups: true, MaxInheritDepth: 1}, expectedInheritParentDepth1)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"parent"}, InheritGroups: true, MaxInheritDepth: 2}, expectedInheritParent)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"parent", "mid"}, InheritGroups: true, MaxInheritDepth: 1}, expectedInheritParentMidDepth1)
 }
 
 type structWithBinary struct {
@@ -777,3 +857,2407 @@ func TestMarshalBinary(t *testing.T) {
 	verifyOutputGivenOptions(t, &s, &Options{Groups: []string{"a"}}, `{"B":"aGVsbG8sIHdvcmxkIQ=="}`)
 	verifyOutputGivenOptions(t, &s, &Options{Groups: []string{"b"}}, `{}`)
 }
+
+type MatchAllGroupsLeaf struct {
+	Untagged string
+}
+
+type TestMatchAllGroups struct {
+	One                string             `groups:"a"`
+	Two                string             `groups:"a,b"`
+	Three              string             `groups:"a,b,c"`
+	Inherited          MatchAllGroupsLeaf `groups:"a,b"`
+	MatchAllGroupsLeaf `groups:"a,c"`
+}
+
+func TestMarshal_MatchAllGroups(t *testing.T) {
+	v := TestMatchAllGroups{
+		One:                "one",
+		Two:                "two",
+		Three:              "three",
+		Inherited:          MatchAllGroupsLeaf{Untagged: "inherited"},
+		MatchAllGroupsLeaf: MatchAllGroupsLeaf{Untagged: "embedded"},
+	}
+
+	// default OR semantics
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"a"}}, `{"One":"one","Two":"two","Three":"three","Inherited":{},"Untagged":"embedded"}`)
+
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"a"}, MatchAllGroups: true}, `{"One":"one"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"b"}, MatchAllGroups: true}, `{}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"a", "b"}, MatchAllGroups: true}, `{"One":"one","Two":"two","Inherited":{}}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"a", "c"}, MatchAllGroups: true}, `{"One":"one","Untagged":"embedded"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"a", "b", "c"}, MatchAllGroups: true}, `{"One":"one","Two":"two","Three":"three","Inherited":{},"Untagged":"embedded"}`)
+
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"a", "b"}, MatchAllGroups: true, InheritGroups: true}, `{"One":"one","Two":"two","Inherited":{"Untagged":"inherited"}}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"a"}, MatchAllGroups: true, InheritGroups: true}, `{"One":"one"}`)
+}
+
+type TestNegatedGroups struct {
+	NotPublic         string `groups:"!public"`
+	AdminNotPublic    string `groups:"admin,!public"`
+	Admin             string `groups:"admin"`
+	NoGroup           string
+	PublicAndNegation string `groups:"public,!public"`
+}
+
+func TestMarshal_NegatedGroups(t *testing.T) {
+	v := TestNegatedGroups{
+		NotPublic:         "not_public",
+		AdminNotPublic:    "admin_not_public",
+		Admin:             "admin",
+		NoGroup:           "no_group",
+		PublicAndNegation: "public_and_negation",
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{}, `{"NotPublic":"not_public","AdminNotPublic":"admin_not_public","Admin":"admin","NoGroup":"no_group","PublicAndNegation":"public_and_negation"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"public"}}, `{}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"admin"}}, `{"NotPublic":"not_public","AdminNotPublic":"admin_not_public","Admin":"admin"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"admin", "public"}}, `{"Admin":"admin"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"other"}}, `{"NotPublic":"not_public"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"public"}, OutputFieldsWithNoGroup: true}, `{"NoGroup":"no_group"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"other"}, OutputFieldsWithNoGroup: true}, `{"NotPublic":"not_public","NoGroup":"no_group"}`)
+}
+
+type TestArrayModel struct {
+	Models [2]AModel `json:"models" groups:"test"`
+	Ints   [3]int    `json:"ints" groups:"test"`
+	Bytes  [4]byte   `json:"bytes" groups:"test"`
+}
+
+func TestMarshal_Array(t *testing.T) {
+	v := TestArrayModel{
+		Models: [2]AModel{{true, true}, {false, true}},
+		Ints:   [3]int{1, 2, 3},
+		Bytes:  [4]byte{1, 2, 254, 255},
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"test"}}, `{"models":[{"something":true},{"something":false}],"ints":[1,2,3],"bytes":[1,2,254,255]}`)
+
+	// like encoding/json, fixed size byte arrays are encoded as arrays of numbers rather than base64
+	expected, err := json.Marshal(v.Bytes)
+	assert.NoError(t, err)
+	actual, err := MarshalJSON(&Options{}, v.Bytes)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), string(actual))
+}
+
+type TestExcludeGroups struct {
+	Detail         string `groups:"detail" exclude_groups:"public"`
+	DetailOrPublic string `groups:"detail,public" exclude_groups:"restricted,public"`
+	NoGroup        string `exclude_groups:"public"`
+}
+
+func TestMarshal_ExcludeGroups(t *testing.T) {
+	v := TestExcludeGroups{
+		Detail:         "detail",
+		DetailOrPublic: "detail_or_public",
+		NoGroup:        "no_group",
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{}, `{"Detail":"detail","DetailOrPublic":"detail_or_public","NoGroup":"no_group"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"detail"}}, `{"Detail":"detail","DetailOrPublic":"detail_or_public"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"detail", "public"}}, `{}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"detail", "restricted"}}, `{"Detail":"detail"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"detail"}, OutputFieldsWithNoGroup: true}, `{"Detail":"detail","DetailOrPublic":"detail_or_public","NoGroup":"no_group"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"public"}, OutputFieldsWithNoGroup: true}, `{}`)
+}
+
+func TestMarshalJSON(t *testing.T) {
+	v := TestGroupsModel{
+		DefaultMarshal: "DefaultMarshal",
+		OnlyGroupTest:  "OnlyGroupTest",
+	}
+
+	actual, err := MarshalJSON(&Options{Groups: []string{"test"}}, v)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"only_group_test":"OnlyGroupTest","group_test_and_other":""}`, string(actual))
+
+	_, err = MarshalJSON(&Options{ApiVersion: version.Must(version.NewVersion("1.0.0"))}, struct {
+		Invalid string `since:"invalid"`
+	}{})
+	assert.Error(t, err)
+}
+
+type TestFieldTagModel struct {
+	Renamed   string `json:"json_renamed" yaml:"yaml_renamed" groups:"test"`
+	OmitEmpty string `json:"json_omit_empty" yaml:"yaml_omit_empty,omitempty" groups:"test"`
+	Skipped   string `json:"json_skipped" yaml:"-" groups:"test"`
+	NoTag     string `groups:"test"`
+}
+
+func TestMarshal_FieldTag(t *testing.T) {
+	v := TestFieldTagModel{
+		Renamed: "renamed",
+		Skipped: "skipped",
+		NoTag:   "no_tag",
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"test"}}, `{"json_renamed":"renamed","json_omit_empty":"","json_skipped":"skipped","NoTag":"no_tag"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"test"}, FieldTag: "yaml"}, `{"yaml_renamed":"renamed","NoTag":"no_tag"}`)
+}
+
+type TestVersionConstraintsModel struct {
+	Windows    string `json:"windows" version:">=2.0.0,<3.0.0 || >=3.4.0"`
+	Precedence string `json:"precedence" version:">=3.0.0" since:"1.0.0" until:"2.0.0"`
+}
+
+func TestMarshal_VersionConstraints(t *testing.T) {
+	v := TestVersionConstraintsModel{
+		Windows:    "windows",
+		Precedence: "precedence",
+	}
+
+	for apiVersion, expected := range map[string]string{
+		"1.9.9": `{}`,
+		"2.0.0": `{"windows":"windows"}`,
+		"2.9.9": `{"windows":"windows"}`,
+		"3.0.0": `{"precedence":"precedence"}`,
+		"3.3.9": `{"precedence":"precedence"}`,
+		"3.4.0": `{"windows":"windows","precedence":"precedence"}`,
+	} {
+		verifyOutputGivenOptions(t, v, &Options{ApiVersion: version.Must(version.NewVersion(apiVersion))}, expected)
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{}, `{"windows":"windows","precedence":"precedence"}`)
+
+	_, err := Marshal(&Options{ApiVersion: version.Must(version.NewVersion("1.0.0"))}, struct {
+		Invalid string `version:">=1.0.0 || invalid"`
+	}{})
+	assert.Error(t, err)
+}
+
+type TestGroupVersionConstraintsModel struct {
+	Email    string `json:"email" groups:"public,internal,partner" version:"public:>=2.0.0;internal:>=1.0.0"`
+	Fallback string `json:"fallback" groups:"public,partner" version:"public:>=2.0.0 || <1.0.0; >=3.0.0"`
+	Since    string `json:"since" groups:"public,partner" version:"public:>=2.0.0" since:"1.5.0"`
+}
+
+func TestMarshal_GroupVersionConstraints(t *testing.T) {
+	v := TestGroupVersionConstraintsModel{Email: "email", Fallback: "fallback", Since: "since"}
+
+	for _, c := range []struct {
+		groups     []string
+		apiVersion string
+		expected   string
+	}{
+		{[]string{"public"}, "0.9.0", `{"fallback":"fallback"}`},
+		{[]string{"public"}, "1.0.0", `{}`},
+		{[]string{"public"}, "2.0.0", `{"email":"email","fallback":"fallback","since":"since"}`},
+		{[]string{"internal"}, "1.0.0", `{"email":"email"}`},
+		{[]string{"public", "internal"}, "1.0.0", `{"email":"email"}`},
+		{[]string{"public", "internal"}, "2.0.0", `{"email":"email","fallback":"fallback","since":"since"}`},
+		// without a scoped group, the entry without group or the since and until tags apply
+		{[]string{"partner"}, "1.0.0", `{"email":"email"}`},
+		{[]string{"partner"}, "1.5.0", `{"email":"email","since":"since"}`},
+		{[]string{"partner"}, "3.0.0", `{"email":"email","fallback":"fallback","since":"since"}`},
+		{[]string{"*"}, "1.0.0", `{"email":"email"}`},
+	} {
+		verifyOutputGivenOptions(t, v, &Options{Groups: c.groups, ApiVersion: version.Must(version.NewVersion(c.apiVersion))}, c.expected)
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"public"}}, `{"email":"email","fallback":"fallback","since":"since"}`)
+
+	_, err := Marshal(&Options{ApiVersion: version.Must(version.NewVersion("1.0.0"))}, struct {
+		Invalid string `version:"public:>=1.0.0;internal:invalid"`
+	}{})
+	assert.IsType(t, InvalidVersionTagError{}, err)
+}
+
+type TestBetweenModel struct {
+	Between  string `json:"between" between:"2.0.0,3.5.0"`
+	Combined string `json:"combined" between:"2.0.0,3.5.0" since:"2.5.0"`
+}
+
+func TestMarshal_Between(t *testing.T) {
+	v := TestBetweenModel{
+		Between:  "between",
+		Combined: "combined",
+	}
+
+	for apiVersion, expected := range map[string]string{
+		"1.9.9": `{}`,
+		"2.0.0": `{"between":"between"}`,
+		"2.5.0": `{"between":"between","combined":"combined"}`,
+		"3.5.0": `{"between":"between","combined":"combined"}`,
+		"3.5.1": `{}`,
+	} {
+		verifyOutputGivenOptions(t, v, &Options{ApiVersion: version.Must(version.NewVersion(apiVersion))}, expected)
+	}
+
+	o := &Options{ApiVersion: version.Must(version.NewVersion("1.0.0"))}
+	_, err := Marshal(o, struct {
+		Invalid string `between:"2.0.0"`
+	}{})
+	assert.Equal(t, InvalidVersionRangeError{Value: "2.0.0"}, err)
+
+	_, err = Marshal(o, struct {
+		Invalid string `between:"2.0.0,3.0.0,4.0.0"`
+	}{})
+	assert.Equal(t, InvalidVersionRangeError{Value: "2.0.0,3.0.0,4.0.0"}, err)
+
+	_, err = Marshal(o, struct {
+		Invalid string `between:"2.0.0,invalid"`
+	}{})
+	assert.Error(t, err)
+}
+
+type TestPrereleaseModel struct {
+	Since      string `json:"since" since:"2.0.0"`
+	Until      string `json:"until" until:"2.0.0"`
+	Constraint string `json:"constraint" version:">=2.0.0"`
+}
+
+func TestMarshal_Prerelease(t *testing.T) {
+	v := TestPrereleaseModel{
+		Since:      "since",
+		Until:      "until",
+		Constraint: "constraint",
+	}
+
+	for apiVersion, expected := range map[string]string{
+		"1.9.9":        `{"until":"until"}`,
+		"2.0.0-rc1":    `{"until":"until"}`,
+		"2.0.0":        `{"since":"since","until":"until","constraint":"constraint"}`,
+		"2.0.0+build1": `{"since":"since","until":"until","constraint":"constraint"}`,
+		"2.0.1-rc1":    `{"since":"since"}`,
+	} {
+		verifyOutputGivenOptions(t, v, &Options{ApiVersion: version.Must(version.NewVersion(apiVersion))}, expected)
+	}
+
+	for apiVersion, expected := range map[string]string{
+		"2.0.0-rc1":       `{"since":"since","until":"until","constraint":"constraint"}`,
+		"2.0.0-rc1+build": `{"since":"since","until":"until","constraint":"constraint"}`,
+		"2.0.1-rc1":       `{"since":"since","constraint":"constraint"}`,
+	} {
+		verifyOutputGivenOptions(t, v, &Options{ApiVersion: version.Must(version.NewVersion(apiVersion)), ReleasePrecedence: true}, expected)
+	}
+
+	// the release is computed once per call, without modifying the passed options
+	o := &Options{ApiVersion: version.Must(version.NewVersion("2.0.0-rc1")), ReleasePrecedence: true}
+	resolved, err := resolveOptions(o)
+	assert.NoError(t, err)
+	assert.Equal(t, "2.0.0", resolved.releaseVersion.String())
+	assert.Nil(t, o.releaseVersion)
+
+	// options passed on to a Marshaller are resolved again if they are changed
+	withoutPrecedence := *resolved
+	withoutPrecedence.ReleasePrecedence = false
+	verifyOutputGivenOptions(t, v, &withoutPrecedence, `{"until":"until"}`)
+}
+
+type TestDefaultGroupModel struct {
+	Ungrouped   string `json:"ungrouped"`
+	Grouped     string `json:"grouped" groups:"api"`
+	NotInternal string `json:"not_internal" groups:"!internal"`
+}
+
+func TestMarshal_DefaultGroup(t *testing.T) {
+	v := TestDefaultGroupModel{
+		Ungrouped:   "ungrouped",
+		Grouped:     "grouped",
+		NotInternal: "not_internal",
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}, DefaultGroup: "default"}, `{"grouped":"grouped","not_internal":"not_internal"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}, DefaultGroup: "default", OutputFieldsWithNoGroup: true}, `{"grouped":"grouped","not_internal":"not_internal"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api", "default"}, DefaultGroup: "default"}, `{"ungrouped":"ungrouped","grouped":"grouped","not_internal":"not_internal"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"default", "internal"}, DefaultGroup: "default"}, `{"ungrouped":"ungrouped"}`)
+
+	// without a DefaultGroup, fields without a group depend on OutputFieldsWithNoGroup
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}}, `{"grouped":"grouped","not_internal":"not_internal"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}, OutputFieldsWithNoGroup: true}, `{"ungrouped":"ungrouped","grouped":"grouped","not_internal":"not_internal"}`)
+}
+
+type TestTagNamesModel struct {
+	Groups    string `json:"groups" groups:"test"`
+	Scopes    string `json:"scopes" scopes:"test"`
+	Since     string `json:"since" since:"2"`
+	Available string `json:"available" available:"2"`
+	Until     string `json:"until" until:"1"`
+	Removed   string `json:"removed" removed:"1"`
+}
+
+func TestMarshal_TagNames(t *testing.T) {
+	v := TestTagNamesModel{
+		Groups:    "groups",
+		Scopes:    "scopes",
+		Since:     "since",
+		Available: "available",
+		Until:     "until",
+		Removed:   "removed",
+	}
+	v15 := version.Must(version.NewVersion("1.5.0"))
+
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"test"}, OutputFieldsWithNoGroup: true, ApiVersion: v15},
+		`{"groups":"groups","scopes":"scopes","available":"available","removed":"removed"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"test"}, OutputFieldsWithNoGroup: true, ApiVersion: v15, GroupTagName: "scopes"},
+		`{"groups":"groups","scopes":"scopes","available":"available","removed":"removed"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"other"}, OutputFieldsWithNoGroup: true, ApiVersion: v15, GroupTagName: "scopes"},
+		`{"groups":"groups","available":"available","removed":"removed"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"test"}, OutputFieldsWithNoGroup: true, ApiVersion: v15, SinceTagName: "available", UntilTagName: "removed"},
+		`{"groups":"groups","scopes":"scopes","since":"since","until":"until"}`)
+}
+
+type TestCycleNode struct {
+	Name     string           `json:"name"`
+	Parent   *TestCycleNode   `json:"parent"`
+	Children []*TestCycleNode `json:"children"`
+}
+
+type TestCycleA struct {
+	Name string      `json:"name"`
+	B    *TestCycleB `json:"b"`
+}
+
+type TestCycleB struct {
+	Name string      `json:"name"`
+	A    *TestCycleA `json:"a"`
+}
+
+func TestMarshal_CyclicReference(t *testing.T) {
+	root := &TestCycleNode{Name: "root"}
+	child := &TestCycleNode{Name: "child", Parent: root}
+	root.Children = []*TestCycleNode{child}
+
+	_, err := Marshal(&Options{}, root)
+	assert.IsType(t, CyclicReferenceError{}, err)
+
+	verifyOutputGivenOptions(t, root, &Options{OnCycle: CycleNil}, `{"name":"root","parent":null,"children":[{"name":"child","parent":null,"children":null}]}`)
+
+	self := &TestCycleNode{Name: "self"}
+	self.Parent = self
+	_, err = Marshal(&Options{}, self)
+	assert.IsType(t, CyclicReferenceError{}, err)
+	verifyOutputGivenOptions(t, self, &Options{OnCycle: CycleNil}, `{"name":"self","parent":null,"children":null}`)
+
+	a := &TestCycleA{Name: "a"}
+	a.B = &TestCycleB{Name: "b", A: a}
+	_, err = Marshal(&Options{}, a)
+	assert.IsType(t, CyclicReferenceError{}, err)
+	verifyOutputGivenOptions(t, a, &Options{OnCycle: CycleNil}, `{"name":"a","b":{"name":"b","a":null}}`)
+
+	// the same pointer occurring multiple times is not a cycle
+	shared := &TestCycleNode{Name: "shared"}
+	verifyOutputGivenOptions(t, []*TestCycleNode{shared, shared}, &Options{}, `[{"name":"shared","parent":null,"children":null},{"name":"shared","parent":null,"children":null}]`)
+}
+
+type TestMapKeyText struct {
+	A, B int
+}
+
+func (k TestMapKeyText) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d-%d", k.A, k.B)), nil
+}
+
+type TestMapKeyString string
+
+type TestMapKeyStringer [2]byte
+
+func (k TestMapKeyStringer) String() string {
+	return fmt.Sprintf("%x", k[:])
+}
+
+type TestMapKeysModel struct {
+	Ints    map[int]AModel              `json:"ints" groups:"test"`
+	Int64s  map[int64]AModel            `json:"int64s" groups:"test"`
+	Uints   map[uint8]AModel            `json:"uints" groups:"test"`
+	Strings map[TestMapKeyString]AModel `json:"strings" groups:"test"`
+	Texts   map[TestMapKeyText]AModel   `json:"texts" groups:"test"`
+}
+
+func TestMarshal_MapKeys(t *testing.T) {
+	v := TestMapKeysModel{
+		Ints:    map[int]AModel{-1: {true, true}},
+		Int64s:  map[int64]AModel{1 << 40: {true, true}},
+		Uints:   map[uint8]AModel{2: {true, true}},
+		Strings: map[TestMapKeyString]AModel{"three": {true, true}},
+		Texts:   map[TestMapKeyText]AModel{{4, 5}: {true, true}},
+	}
+
+	actual, err := MarshalJSON(&Options{Groups: []string{"test"}}, v)
+	assert.NoError(t, err)
+	expected, err := json.Marshal(map[string]interface{}{
+		"ints":    map[int]map[string]bool{-1: {"something": true}},
+		"int64s":  map[int64]map[string]bool{1 << 40: {"something": true}},
+		"uints":   map[uint8]map[string]bool{2: {"something": true}},
+		"strings": map[TestMapKeyString]map[string]bool{"three": {"something": true}},
+		"texts":   map[TestMapKeyText]map[string]bool{{4, 5}: {"something": true}},
+	})
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(actual))
+
+	actual, err = MarshalJSON(&Options{}, map[TestMapKeyStringer]string{{0xca, 0xfe}: "stringer"})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"cafe":"stringer"}`, string(actual))
+
+	_, err = Marshal(&Options{}, map[float64]string{1.5: "float"})
+	assert.Equal(t, MarshalInvalidTypeError{t: reflect.Float64, data: map[float64]string{1.5: "float"}}, err)
+
+	_, err = Marshal(&Options{}, map[bool]string{true: "bool"})
+	assert.Equal(t, MarshalInvalidTypeError{t: reflect.Bool, data: map[bool]string{true: "bool"}}, err)
+}
+
+type TestQuotedModel struct {
+	Int            int       `json:"int,string"`
+	Uint           uint8     `json:"uint,string"`
+	Float          float64   `json:"float,string"`
+	Bool           bool      `json:"bool,string"`
+	String         string    `json:"string,string"`
+	IntPtr         *int      `json:"int_ptr,string"`
+	NilPtr         *int      `json:"nil_ptr,string"`
+	OmitEmpty      int       `json:"omit_empty,omitempty,string"`
+	OmitEmptyBool  bool      `json:"omit_empty_bool,string,omitempty"`
+	NotApplicable  []int     `json:"not_applicable,string"`
+	MarshalledTime time.Time `json:"marshalled_time,string"`
+}
+
+func TestMarshal_Quoted(t *testing.T) {
+	i := 42
+	v := TestQuotedModel{
+		Int:            -1,
+		Uint:           2,
+		Float:          3.5,
+		Bool:           true,
+		String:         "four",
+		IntPtr:         &i,
+		NotApplicable:  []int{5},
+		MarshalledTime: time.Date(2017, 1, 20, 18, 11, 0, 0, time.UTC),
+	}
+
+	actual, err := MarshalJSON(&Options{}, v)
+	assert.NoError(t, err)
+	expected, err := json.Marshal(v)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(actual))
+
+	v.OmitEmpty = 6
+	v.OmitEmptyBool = true
+	actual, err = MarshalJSON(&Options{}, v)
+	assert.NoError(t, err)
+	expected, err = json.Marshal(v)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(actual))
+}
+
+func TestMarshal_QuotedEncoders(t *testing.T) {
+	v := TestQuotedModel{Int: 1, Float: 0.25, Bool: true, OmitEmptyBool: true}
+	expected, err := json.Marshal(v)
+	assert.NoError(t, err)
+
+	actual, err := MarshalJSON(&Options{PreserveOrder: true}, v)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), string(actual))
+
+	var buf bytes.Buffer
+	assert.NoError(t, NewEncoder(&buf, &Options{}).Encode(v))
+	assert.JSONEq(t, string(expected), buf.String())
+}
+
+type TestSlicesModel struct {
+	Nil       []AModel `json:"nil" groups:"test"`
+	Empty     []AModel `json:"empty" groups:"test"`
+	Populated []AModel `json:"populated" groups:"test"`
+}
+
+func TestMarshal_NilSlice(t *testing.T) {
+	v := TestSlicesModel{
+		Empty:     []AModel{},
+		Populated: []AModel{{true, true}},
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"test"}}, `{"nil":null,"empty":[],"populated":[{"something":true}]}`)
+}
+
+type TestAliasModel struct {
+	UserID string `json:"user_id" groups:"public,internal" alias:"public=public_id,internal=uid"`
+	Name   string `json:"name" groups:"public,internal,admin"`
+}
+
+func TestMarshal_Alias(t *testing.T) {
+	v := TestAliasModel{
+		UserID: "42",
+		Name:   "name",
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"public"}}, `{"public_id":"42","name":"name"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"internal"}}, `{"uid":"42","name":"name"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"internal", "public"}}, `{"uid":"42","name":"name"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"public", "internal"}}, `{"public_id":"42","name":"name"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"admin"}}, `{"name":"name"}`)
+	verifyOutputGivenOptions(t, v, &Options{}, `{"user_id":"42","name":"name"}`)
+}
+
+type TestTransformModel struct {
+	Email       string `json:"email" transform:"maskEmail"`
+	Name        string `json:"name"`
+	TrustedName string `json:"trusted_name" groups:"trusted" transform:"upper"`
+}
+
+func TestMarshal_FieldTransformers(t *testing.T) {
+	v := TestTransformModel{
+		Email:       "jane@example.com",
+		Name:        "Jane",
+		TrustedName: "Jane",
+	}
+	transformers := map[string]func(interface{}) interface{}{
+		"maskEmail": func(value interface{}) interface{} {
+			email := value.(string)
+			return email[:1] + "***" + email[strings.Index(email, "@"):]
+		},
+		"upper": func(value interface{}) interface{} {
+			return strings.ToUpper(value.(string))
+		},
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{FieldTransformers: transformers}, `{"email":"j***@example.com","name":"Jane","trusted_name":"JANE"}`)
+	verifyOutputGivenOptions(t, v, &Options{FieldTransformers: transformers, Groups: []string{"other"}, OutputFieldsWithNoGroup: true}, `{"email":"j***@example.com","name":"Jane"}`)
+
+	_, err := Marshal(&Options{}, v)
+	assert.Equal(t, UnknownTransformError{Name: "maskEmail"}, err)
+}
+
+func TestMarshalContext(t *testing.T) {
+	models := make([]TestRecursiveModel, 10000)
+	for i := range models {
+		models[i] = TestRecursiveModel{
+			SomeData:   "SomeData",
+			GroupsData: []*TestGroupsModel{{OnlyGroupTest: "OnlyGroupTest"}},
+		}
+	}
+	o := &Options{Groups: []string{"test"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	actual, err := MarshalContext(ctx, o, models)
+	assert.NoError(t, err)
+	assert.Len(t, actual, 10000)
+
+	cancel()
+	actual, err = MarshalContext(ctx, o, models)
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, actual)
+
+	actual, err = MarshalContext(ctx, o, []int{1, 2, 3})
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, actual)
+}
+
+type CancellingValue struct {
+	cancel context.CancelFunc
+}
+
+func (c CancellingValue) MarshalSheriff(mc MarshallerContext) (interface{}, error) {
+	c.cancel()
+	return "cancelled", nil
+}
+
+func TestMarshalContext_CancelledDuringMarshalling(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	data := make([]interface{}, 3000)
+	for i := range data {
+		data[i] = map[string]interface{}{"nested": []int{i}}
+	}
+	data[10] = CancellingValue{cancel}
+
+	actual, err := MarshalContext(ctx, &Options{}, data)
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, actual)
+
+	// maps of values which aren't structs are checked as well
+	m := make(map[int]int, 2000)
+	for i := 0; i < 2000; i++ {
+		m[i] = i
+	}
+	_, err = MarshalContext(ctx, &Options{}, m)
+	assert.Equal(t, context.Canceled, err)
+
+	deadline, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = MarshalContext(deadline, &Options{}, map[string]interface{}{"nested": []int{1}})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+type OmitEmptyChild struct {
+	Visible string `json:"visible,omitempty" groups:"test"`
+	Hidden  string `json:"hidden,omitempty" groups:"other"`
+}
+
+type TestOmitEmptyStructModel struct {
+	Empty       OmitEmptyChild  `json:"empty,omitempty" groups:"test"`
+	EmptyPtr    *OmitEmptyChild `json:"empty_ptr,omitempty" groups:"test"`
+	Filtered    OmitEmptyChild  `json:"filtered,omitempty" groups:"test"`
+	NotEmpty    OmitEmptyChild  `json:"not_empty,omitempty" groups:"test"`
+	NoOmitEmpty OmitEmptyChild  `json:"no_omit_empty" groups:"test"`
+}
+
+func TestMarshal_OmitEmptyStruct(t *testing.T) {
+	v := TestOmitEmptyStructModel{
+		EmptyPtr: &OmitEmptyChild{},
+		Filtered: OmitEmptyChild{Hidden: "hidden"},
+		NotEmpty: OmitEmptyChild{Visible: "visible"},
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"test"}}, `{"not_empty":{"visible":"visible"},"no_omit_empty":{}}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"test", "other"}}, `{"filtered":{"hidden":"hidden"},"not_empty":{"visible":"visible"},"no_omit_empty":{}}`)
+}
+
+// the api tag is used as go vet reports duplicate json tags
+type ShadowBase struct {
+	ID      string `api:"id"`
+	Name    string
+	Tagged  string `api:"tagged"`
+	Dropped string `api:"dropped"`
+	Deep    string `api:"deep"`
+}
+
+type ShadowOther struct {
+	Tagged   string `api:"Tagged"`
+	Dropped  string `api:"dropped"`
+	Untagged string `api:"tagged_other"`
+}
+
+type ShadowDeep struct {
+	ShadowDeeper
+}
+
+type ShadowDeeper struct {
+	Deep string `api:"deep"`
+}
+
+type TestShadowingModel struct {
+	ShadowBase
+	ShadowOther
+	ShadowDeep
+	ID   string `api:"id"`
+	Name string
+}
+
+func TestMarshal_Shadowing(t *testing.T) {
+	v := TestShadowingModel{
+		ShadowBase: ShadowBase{
+			ID:      "base_id",
+			Name:    "base_name",
+			Tagged:  "base_tagged",
+			Dropped: "base_dropped",
+			Deep:    "base_deep",
+		},
+		ShadowOther: ShadowOther{
+			Tagged:  "other_tagged",
+			Dropped: "other_dropped",
+		},
+		ShadowDeep: ShadowDeep{ShadowDeeper{Deep: "deeper"}},
+		ID:         "id",
+		Name:       "name",
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{FieldTag: "api"}, `{"id":"id","Name":"name","tagged":"base_tagged","Tagged":"other_tagged","tagged_other":"","deep":"base_deep"}`)
+
+	type duplicate struct {
+		A string `api:"a"`
+		B string `api:"a"`
+		C string
+	}
+	verifyOutputGivenOptions(t, duplicate{"a", "b", "c"}, &Options{FieldTag: "api"}, `{"C":"c"}`)
+
+	type taggedWins struct {
+		ShadowTaggedDeep
+		ShadowUntaggedDeep
+	}
+	verifyOutputGivenOptions(t, taggedWins{ShadowTaggedDeep{"tagged"}, ShadowUntaggedDeep{"untagged"}}, &Options{FieldTag: "api"}, `{"Deep":"tagged"}`)
+}
+
+type ShadowTaggedDeep struct {
+	Tagged string `api:"Deep"`
+}
+
+type ShadowUntaggedDeep struct {
+	Deep string
+}
+
+type TestTimeFormatModel struct {
+	Birthdate    time.Time  `json:"birthdate" timeformat:"2006-01-02"`
+	BirthdatePtr *time.Time `json:"birthdate_ptr" timeformat:"02.01.2006"`
+	NilPtr       *time.Time `json:"nil_ptr" timeformat:"2006-01-02"`
+	Default      time.Time  `json:"default"`
+	NotATime     string     `json:"not_a_time" timeformat:"2006-01-02"`
+}
+
+func TestMarshal_TimeFormat(t *testing.T) {
+	birthdate := time.Date(2017, 1, 20, 18, 11, 0, 0, time.UTC)
+	v := TestTimeFormatModel{
+		Birthdate:    birthdate,
+		BirthdatePtr: &birthdate,
+		Default:      birthdate,
+		NotATime:     "not a time",
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{}, `{"birthdate":"2017-01-20","birthdate_ptr":"20.01.2017","nil_ptr":null,"default":"2017-01-20T18:11:00Z","not_a_time":"not a time"}`)
+}
+
+type TestTimeFormatOptionModel struct {
+	Time       time.Time   `json:"time"`
+	TimePtr    *time.Time  `json:"time_ptr"`
+	Times      []time.Time `json:"times"`
+	Tagged     time.Time   `json:"tagged" timeformat:"2006-01-02 15:04"`
+	TaggedUnix time.Time   `json:"tagged_unix" timeformat:"unix"`
+}
+
+func TestMarshal_TimeFormatOption(t *testing.T) {
+	tm := time.Date(2017, 1, 20, 18, 11, 0, 0, time.UTC)
+	v := TestTimeFormatOptionModel{
+		Time:       tm,
+		TimePtr:    &tm,
+		Times:      []time.Time{tm},
+		Tagged:     tm,
+		TaggedUnix: tm,
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{}, `{"time":"2017-01-20T18:11:00Z","time_ptr":"2017-01-20T18:11:00Z","times":["2017-01-20T18:11:00Z"],"tagged":"2017-01-20 18:11","tagged_unix":1484935860}`)
+	verifyOutputGivenOptions(t, v, &Options{TimeFormat: time.RFC1123}, `{"time":"Fri, 20 Jan 2017 18:11:00 UTC","time_ptr":"Fri, 20 Jan 2017 18:11:00 UTC","times":["Fri, 20 Jan 2017 18:11:00 UTC"],"tagged":"2017-01-20 18:11","tagged_unix":1484935860}`)
+	verifyOutputGivenOptions(t, v, &Options{TimeFormat: TimeFormatUnix}, `{"time":1484935860,"time_ptr":1484935860,"times":[1484935860],"tagged":"2017-01-20 18:11","tagged_unix":1484935860}`)
+	verifyOutputGivenOptions(t, v, &Options{TimeFormat: time.RFC3339, TimeLocation: time.FixedZone("CET", 3600)}, `{"time":"2017-01-20T19:11:00+01:00","time_ptr":"2017-01-20T19:11:00+01:00","times":["2017-01-20T19:11:00+01:00"],"tagged":"2017-01-20 19:11","tagged_unix":1484935860}`)
+}
+
+type TestWildcardModel struct {
+	Grouped      string     `groups:"a"`
+	MultiGrouped string     `groups:"b,c"`
+	NotPublic    string     `groups:"!public"`
+	Excluded     string     `groups:"a" exclude_groups:"public"`
+	Ungrouped    string     `json:"ungrouped"`
+	Skipped      string     `json:"-" groups:"a"`
+	Inherited    HalfTagged `groups:"a"`
+}
+
+func TestMarshal_WildcardGroup(t *testing.T) {
+	v := TestWildcardModel{
+		Grouped:      "grouped",
+		MultiGrouped: "multi_grouped",
+		NotPublic:    "not_public",
+		Excluded:     "excluded",
+		Ungrouped:    "ungrouped",
+		Skipped:      "skipped",
+		Inherited:    HalfTagged{WithTag: "with_tag", WithoutTag: "without_tag"},
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"*"}}, `{"Grouped":"grouped","MultiGrouped":"multi_grouped","NotPublic":"not_public","Excluded":"excluded","Inherited":{"WithTag":"with_tag"}}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"*"}, OutputFieldsWithNoGroup: true}, `{"Grouped":"grouped","MultiGrouped":"multi_grouped","NotPublic":"not_public","Excluded":"excluded","ungrouped":"ungrouped","Inherited":{"WithTag":"with_tag","WithoutTag":"without_tag"}}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"*", "public"}}, `{"Grouped":"grouped","MultiGrouped":"multi_grouped","Inherited":{"WithTag":"with_tag"}}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"*"}, MatchAllGroups: true}, `{"Grouped":"grouped","MultiGrouped":"multi_grouped","NotPublic":"not_public","Excluded":"excluded","Inherited":{"WithTag":"with_tag"}}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"*"}, InheritGroups: true}, `{"Grouped":"grouped","MultiGrouped":"multi_grouped","NotPublic":"not_public","Excluded":"excluded","Inherited":{"WithTag":"with_tag","WithoutTag":"without_tag"}}`)
+}
+
+type TestWildcardVersionsModel struct {
+	Current string `json:"current" groups:"api"`
+	Added   string `json:"added" groups:"admin" since:"2.0.0"`
+	Removed string `json:"removed" groups:"internal" until:"1.0.0"`
+}
+
+func TestMarshal_WildcardGroupVersions(t *testing.T) {
+	v := TestWildcardVersionsModel{Current: "current", Added: "added", Removed: "removed"}
+
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"*"}}, `{"current":"current","added":"added","removed":"removed"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"*"}, ApiVersion: version.Must(version.NewVersion("1.5.0"))}, `{"current":"current"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"*"}, ApiVersion: version.Must(version.NewVersion("2.0.0"))}, `{"current":"current","added":"added"}`)
+}
+
+type NilJSONMarshaler struct{}
+
+func (m *NilJSONMarshaler) MarshalJSON() ([]byte, error) {
+	return []byte(`null`), nil
+}
+
+type TestOmitEmptyNilMarshallerModel struct {
+	Pointer       *NilJSONMarshaler      `json:"pointer,omitempty"`
+	Interface     json.Marshaler         `json:"interface,omitempty"`
+	TextInterface encoding.TextMarshaler `json:"text_interface,omitempty"`
+	Marshaller    Marshaller             `json:"marshaller,omitempty"`
+	NotOmitted    json.Marshaler         `json:"not_omitted"`
+}
+
+func TestMarshal_OmitEmptyNilMarshaller(t *testing.T) {
+	v := TestOmitEmptyNilMarshallerModel{
+		Interface:     (*NilJSONMarshaler)(nil),
+		TextInterface: (*TestMapKeyText)(nil),
+		Marshaller:    (*IsMarshaller)(nil),
+		NotOmitted:    (*NilJSONMarshaler)(nil),
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{}, `{"not_omitted":null}`)
+}
+
+func TestMarshal_RequireStruct(t *testing.T) {
+	o := &Options{RequireStruct: true}
+
+	for _, data := range []interface{}{
+		42,
+		"string",
+		map[string]string{"key": "value"},
+		[]string{"not", "structs"},
+		nil,
+	} {
+		_, err := Marshal(o, data)
+		assert.IsType(t, MarshalInvalidTypeError{}, err, "%#v", data)
+	}
+
+	for _, data := range []interface{}{
+		TestGroupsModel{},
+		&TestGroupsModel{},
+		[]TestGroupsModel{{}},
+		[1]*TestGroupsModel{{}},
+	} {
+		_, err := Marshal(o, data)
+		assert.NoError(t, err, "%#v", data)
+	}
+
+	actual, err := Marshal(&Options{}, 42)
+	assert.NoError(t, err)
+	assert.Equal(t, 42, actual)
+}
+
+type TestErrorPathPreferences struct {
+	Values map[float64]string `json:"values"`
+}
+
+type TestErrorPathModel struct {
+	Preferences map[string][]TestErrorPathPreferences `json:"preferences"`
+}
+
+func TestMarshal_ErrorPath(t *testing.T) {
+	v := &TestErrorPathModel{
+		Preferences: map[string][]TestErrorPathPreferences{
+			"key": {{}, {Values: map[float64]string{1.5: "float"}}},
+		},
+	}
+
+	_, err := Marshal(&Options{}, v)
+	assert.Equal(t, "TestErrorPathModel.Preferences[key][1].Values", err.(MarshalInvalidTypeError).Path)
+	assert.EqualError(t, err, "marshaller: Unable to marshal type float64. Struct required. Path: TestErrorPathModel.Preferences[key][1].Values")
+
+	_, err = Marshal(&Options{}, []interface{}{v})
+	assert.Equal(t, "[0].Preferences[key][1].Values", err.(MarshalInvalidTypeError).Path)
+}
+
+func TestMarshal_DefaultGroups(t *testing.T) {
+	v := TestGroupsModel{
+		DefaultMarshal:     "DefaultMarshal",
+		OnlyGroupTest:      "OnlyGroupTest",
+		OnlyGroupTestOther: "OnlyGroupTestOther",
+		GroupTestAndOther:  "GroupTestAndOther",
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{DefaultGroups: []string{"test"}}, `{"only_group_test":"OnlyGroupTest","group_test_and_other":"GroupTestAndOther"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"test-other"}, DefaultGroups: []string{"test"}}, `{"only_group_test_other":"OnlyGroupTestOther","group_test_and_other":"GroupTestAndOther"}`)
+	verifyOutputGivenOptions(t, v, &Options{}, `{"default_marshal":"DefaultMarshal","only_group_test":"OnlyGroupTest","only_group_test_other":"OnlyGroupTestOther","group_test_and_other":"GroupTestAndOther"}`)
+
+	var actual TestGroupsModel
+	err := Unmarshal(&Options{DefaultGroups: []string{"test"}}, map[string]interface{}{"only_group_test_other": "OnlyGroupTestOther"}, &actual)
+	assert.Equal(t, UnmarshalExcludedFieldError{Key: "only_group_test_other"}, err)
+}
+
+type KeyTransformerEmbedded struct {
+	EmbeddedField string `json:"embeddedField"`
+	ShadowedField string `json:"firstName"`
+}
+
+type KeyTransformerChild struct {
+	PostalCode string `json:"postalCode"`
+}
+
+type TestKeyTransformerModel struct {
+	KeyTransformerEmbedded
+	FirstName string                         `json:"firstName"`
+	UserID    string                         `json:"userID" alias:"internal=internalID"`
+	Address   KeyTransformerChild            `json:"homeAddress"`
+	Addresses []KeyTransformerChild          `json:"otherAddresses"`
+	ByName    map[string]KeyTransformerChild `json:"addressesByName"`
+}
+
+func TestMarshal_KeyTransformer(t *testing.T) {
+	v := TestKeyTransformerModel{
+		KeyTransformerEmbedded: KeyTransformerEmbedded{EmbeddedField: "embedded", ShadowedField: "shadowed"},
+		FirstName:              "first",
+		UserID:                 "id",
+		Address:                KeyTransformerChild{PostalCode: "8000"},
+		Addresses:              []KeyTransformerChild{{PostalCode: "3000"}},
+		ByName:                 map[string]KeyTransformerChild{"workAddress": {PostalCode: "4000"}},
+	}
+
+	identity := func(key string) string { return key }
+	verifyOutputGivenOptions(t, v, &Options{KeyTransformer: identity}, `{"embeddedField":"embedded","firstName":"first","userID":"id","homeAddress":{"postalCode":"8000"},"otherAddresses":[{"postalCode":"3000"}],"addressesByName":{"workAddress":{"postalCode":"4000"}}}`)
+	verifyOutputGivenOptions(t, v, &Options{KeyTransformer: SnakeCase}, `{"embedded_field":"embedded","first_name":"first","user_id":"id","home_address":{"postal_code":"8000"},"other_addresses":[{"postal_code":"3000"}],"addresses_by_name":{"workAddress":{"postal_code":"4000"}}}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"internal"}, OutputFieldsWithNoGroup: true, KeyTransformer: KebabCase}, `{"embedded-field":"embedded","first-name":"first","internal-id":"id","home-address":{"postal-code":"8000"},"other-addresses":[{"postal-code":"3000"}],"addresses-by-name":{"workAddress":{"postal-code":"4000"}}}`)
+
+	var actual TestKeyTransformerModel
+	err := Unmarshal(&Options{KeyTransformer: SnakeCase}, map[string]interface{}{"first_name": "first", "embedded_field": "embedded"}, &actual)
+	assert.NoError(t, err)
+	assert.Equal(t, TestKeyTransformerModel{KeyTransformerEmbedded: KeyTransformerEmbedded{EmbeddedField: "embedded"}, FirstName: "first"}, actual)
+}
+
+type BinaryOnly struct {
+	Value  string `json:"value"`
+	Hidden string `json:"hidden" groups:"admin"`
+}
+
+func (b BinaryOnly) MarshalBinary() ([]byte, error) {
+	return []byte(b.Value), nil
+}
+
+type TestBinaryMarshalerModel struct {
+	Binary BinaryOnly `json:"binary" groups:"api"`
+}
+
+func TestMarshal_BinaryMarshaler(t *testing.T) {
+	v := TestBinaryMarshalerModel{Binary: BinaryOnly{Value: "value", Hidden: "hidden"}}
+
+	actual, err := Marshal(&Options{Groups: []string{"api"}}, v)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"binary": "dmFsdWU="}, actual)
+
+	// the binary encoding is output like a []byte by encoding/json
+	expected, err := json.Marshal(map[string][]byte{"binary": []byte("value")})
+	assert.NoError(t, err)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}}, string(expected))
+
+	var nilBinary *BinaryOnly
+	verifyOutputGivenOptions(t, []interface{}{nilBinary, &BinaryOnly{Value: "pointer"}}, &Options{}, `[null,"cG9pbnRlcg=="]`)
+	verifyOutputGivenOptions(t, TestBinaryMarshalerModel{}, &Options{}, `{"binary":""}`)
+	// types implementing json.Marshaler or encoding.TextMarshaler as well are left to encoding/json
+	verifyOutputGivenOptions(t, []interface{}{time.Date(2017, 1, 20, 18, 11, 0, 0, time.UTC)}, &Options{}, `["2017-01-20T18:11:00Z"]`)
+}
+
+type EmbeddedInterface interface{}
+
+type EmbeddedInterfaceValue struct {
+	Public  string `json:"public" groups:"api"`
+	Private string `json:"private" groups:"admin"`
+}
+
+type TestEmbeddedInterfaceModel struct {
+	EmbeddedInterface `groups:"api"`
+	Name              string `json:"name" groups:"api"`
+}
+
+func TestMarshal_EmbeddedInterface(t *testing.T) {
+	value := EmbeddedInterfaceValue{Public: "public", Private: "private"}
+
+	v := TestEmbeddedInterfaceModel{EmbeddedInterface: value, Name: "name"}
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}}, `{"name":"name","public":"public"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"admin"}}, `{"private":"private"}`)
+
+	v = TestEmbeddedInterfaceModel{EmbeddedInterface: &value, Name: "name"}
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}}, `{"name":"name","public":"public"}`)
+
+	// values other than structs are output as the field
+	v = TestEmbeddedInterfaceModel{EmbeddedInterface: "string", Name: "name"}
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}}, `{"EmbeddedInterface":"string","name":"name"}`)
+
+	v = TestEmbeddedInterfaceModel{Name: "name"}
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}}, `{"EmbeddedInterface":null,"name":"name"}`)
+}
+
+type TestExposedFieldsModel struct {
+	Name     string `json:"name" groups:"api"`
+	Override string `json:"override" groups:"api"`
+	secret   string
+	child    UnmarshalChild
+}
+
+func (m *TestExposedFieldsModel) SheriffFields() map[string]interface{} {
+	return map[string]interface{}{
+		"secret":   m.secret,
+		"override": "overridden",
+		"child":    m.child,
+	}
+}
+
+func TestMarshal_ExposedFields(t *testing.T) {
+	v := &TestExposedFieldsModel{
+		Name:     "name",
+		Override: "override",
+		secret:   "secret",
+		child:    UnmarshalChild{Public: "public", Private: "private"},
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}}, `{"name":"name","override":"overridden","secret":"secret","child":{"public":"public"}}`)
+
+	// the method has a pointer receiver
+	verifyOutputGivenOptions(t, *v, &Options{Groups: []string{"api"}}, `{"name":"name","override":"override"}`)
+	verifyOutputGivenOptions(t, []TestExposedFieldsModel{*v}, &Options{Groups: []string{"api"}}, `[{"name":"name","override":"overridden","secret":"secret","child":{"public":"public"}}]`)
+}
+
+type TestExposedFieldsCaseModel struct {
+	UserName    string `json:"userName"`
+	Override    string `json:"overrideValue"`
+	secretValue string
+}
+
+func (m TestExposedFieldsCaseModel) SheriffFields() map[string]interface{} {
+	return map[string]interface{}{
+		"secretValue":   m.secretValue,
+		"overrideValue": "overridden",
+	}
+}
+
+func TestMarshal_ExposedFieldsKeyTransformer(t *testing.T) {
+	v := TestExposedFieldsCaseModel{UserName: "name", Override: "override", secretValue: "secret"}
+
+	// exposed keys are transformed like the keys of struct fields, so they still override them
+	verifyOutputGivenOptions(t, v, &Options{KeyTransformer: SnakeCase}, `{"user_name":"name","override_value":"overridden","secret_value":"secret"}`)
+	verifyOutputGivenOptions(t, v, &Options{}, `{"userName":"name","overrideValue":"overridden","secretValue":"secret"}`)
+}
+
+type TestMapKeyPoint struct {
+	X, Y int
+}
+
+type TestMapKeyFuncModel struct {
+	Floats map[float64]string         `json:"floats"`
+	Points map[TestMapKeyPoint]string `json:"points"`
+	Ints   map[int]string             `json:"ints"`
+}
+
+func TestMarshal_MapKeyFunc(t *testing.T) {
+	v := TestMapKeyFuncModel{
+		Floats: map[float64]string{1.5: "float"},
+		Points: map[TestMapKeyPoint]string{{1, 2}: "point"},
+		Ints:   map[int]string{3: "int"},
+	}
+	mapKeyFunc := func(key reflect.Value) (string, error) {
+		if p, ok := key.Interface().(TestMapKeyPoint); ok {
+			return fmt.Sprintf("%d/%d", p.X, p.Y), nil
+		}
+		return fmt.Sprintf("key:%v", key.Interface()), nil
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{MapKeyFunc: mapKeyFunc}, `{"floats":{"key:1.5":"float"},"points":{"1/2":"point"},"ints":{"key:3":"int"}}`)
+
+	_, err := Marshal(&Options{}, v)
+	assert.IsType(t, MarshalInvalidTypeError{}, err)
+
+	_, err = Marshal(&Options{MapKeyFunc: func(key reflect.Value) (string, error) {
+		return "", errors.New("unsupported key")
+	}}, v)
+	assert.EqualError(t, err, "unsupported key")
+}
+
+type InheritDepthEmbedded struct {
+	Promoted string
+	Deep     LeafRecord
+}
+
+type InheritDepthChild struct {
+	InheritDepthEmbedded
+	Direct string
+}
+
+type TestInheritDepthModel struct {
+	Child InheritDepthChild `groups:"a"`
+}
+
+func TestMarshal_MaxInheritDepthEmbedded(t *testing.T) {
+	v := TestInheritDepthModel{
+		Child: InheritDepthChild{
+			InheritDepthEmbedded: InheritDepthEmbedded{
+				Promoted: "promoted",
+				Deep:     LeafRecord{TaggedInLeaf: "tagged", UntaggedInLeaf: "untagged"},
+			},
+			Direct: "direct",
+		},
+	}
+
+	// promoted fields are on the same level as the fields of the embedding struct
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"a"}, InheritGroups: true, MaxInheritDepth: 1}, `{"Child":{"Promoted":"promoted","Deep":{},"Direct":"direct"}}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"a"}, InheritGroups: true, MaxInheritDepth: 2}, `{"Child":{"Promoted":"promoted","Deep":{"TaggedInLeaf":"tagged","UntaggedInLeaf":"untagged"},"Direct":"direct"}}`)
+}
+
+type ContextAwareValue struct {
+	Value string
+}
+
+func (c ContextAwareValue) MarshalSheriff(mc MarshallerContext) (interface{}, error) {
+	for _, group := range mc.InheritedGroups {
+		if group == "detail" {
+			return map[string]interface{}{"value": c.Value, "groups": mc.Groups, "api_version": mc.ApiVersion.String()}, nil
+		}
+	}
+	return "redacted", nil
+}
+
+func (c ContextAwareValue) Marshal(options *Options) (interface{}, error) {
+	return "not called", nil
+}
+
+type TestContextMarshallerChild struct {
+	Value ContextAwareValue `json:"value"`
+}
+
+type TestContextMarshallerModel struct {
+	Detail  TestContextMarshallerChild `json:"detail" groups:"detail"`
+	Summary TestContextMarshallerChild `json:"summary" groups:"summary"`
+}
+
+func TestMarshal_ContextMarshaller(t *testing.T) {
+	v := TestContextMarshallerModel{
+		Detail:  TestContextMarshallerChild{Value: ContextAwareValue{"detail"}},
+		Summary: TestContextMarshallerChild{Value: ContextAwareValue{"summary"}},
+	}
+	o := &Options{Groups: []string{"detail", "summary"}, InheritGroups: true, ApiVersion: version.Must(version.NewVersion("1.2.0"))}
+
+	verifyOutputGivenOptions(t, v, o, `{"detail":{"value":{"value":"detail","groups":["detail","summary"],"api_version":"1.2.0"}},"summary":{"value":"redacted"}}`)
+
+	var b bytes.Buffer
+	assert.NoError(t, NewEncoder(&b, o).Encode(v))
+	assert.JSONEq(t, `{"detail":{"value":{"value":"detail","groups":["detail","summary"],"api_version":"1.2.0"}},"summary":{"value":"redacted"}}`, b.String())
+}
+
+type TestGroupsOmitEmptyModel struct {
+	Detail        string               `json:"detail" groups_omitempty:"detail"`
+	DetailSummary string               `json:"detail_summary" groups:"summary" groups_omitempty:"detail"`
+	Child         GroupsOmitEmptyChild `json:"child" groups_omitempty:"detail"`
+}
+
+type GroupsOmitEmptyChild struct {
+	Secret string `json:"secret" groups:"admin"`
+}
+
+func TestMarshal_GroupsOmitEmpty(t *testing.T) {
+	present := TestGroupsOmitEmptyModel{Detail: "detail", DetailSummary: "detail_summary", Child: GroupsOmitEmptyChild{Secret: "secret"}}
+	empty := TestGroupsOmitEmptyModel{}
+
+	// in group
+	verifyOutputGivenOptions(t, present, &Options{Groups: []string{"detail"}}, `{"detail":"detail","detail_summary":"detail_summary"}`)
+	verifyOutputGivenOptions(t, empty, &Options{Groups: []string{"detail"}}, `{}`)
+	// out of group
+	verifyOutputGivenOptions(t, present, &Options{Groups: []string{"other"}}, `{}`)
+	verifyOutputGivenOptions(t, empty, &Options{Groups: []string{"other"}}, `{}`)
+
+	// omitempty only applies if a group of groups_omitempty is requested
+	verifyOutputGivenOptions(t, empty, &Options{Groups: []string{"summary"}}, `{"detail_summary":""}`)
+	verifyOutputGivenOptions(t, present, &Options{Groups: []string{"detail", "admin"}}, `{"detail":"detail","detail_summary":"detail_summary","child":{"secret":"secret"}}`)
+}
+
+type OmitEmptyOptionChild struct {
+	Value string `json:"value"`
+}
+
+type TestOmitEmptyOptionModel struct {
+	String   string                `json:"string"`
+	Int      int                   `json:"int"`
+	Slice    []string              `json:"slice"`
+	Ptr      *string               `json:"ptr"`
+	Child    OmitEmptyOptionChild  `json:"child"`
+	ChildPtr *OmitEmptyOptionChild `json:"child_ptr"`
+}
+
+type OmitEmptyTagChild struct {
+	Value string `json:"value,omitempty"`
+}
+
+type TestOmitEmptyTagModel struct {
+	String   string             `json:"string,omitempty"`
+	Int      int                `json:"int,omitempty"`
+	Slice    []string           `json:"slice,omitempty"`
+	Ptr      *string            `json:"ptr,omitempty"`
+	Child    OmitEmptyTagChild  `json:"child,omitempty"`
+	ChildPtr *OmitEmptyTagChild `json:"child_ptr,omitempty"`
+}
+
+func TestMarshal_OmitEmptyOption(t *testing.T) {
+	empty := ""
+	for _, c := range []struct {
+		option TestOmitEmptyOptionModel
+		tagged TestOmitEmptyTagModel
+	}{
+		{TestOmitEmptyOptionModel{}, TestOmitEmptyTagModel{}},
+		{
+			TestOmitEmptyOptionModel{String: "string", Int: 1, Slice: []string{"a"}, Ptr: &empty, Child: OmitEmptyOptionChild{"child"}, ChildPtr: &OmitEmptyOptionChild{}},
+			TestOmitEmptyTagModel{String: "string", Int: 1, Slice: []string{"a"}, Ptr: &empty, Child: OmitEmptyTagChild{"child"}, ChildPtr: &OmitEmptyTagChild{}},
+		},
+	} {
+		compact, err := MarshalJSON(&Options{OmitEmpty: true}, c.option)
+		assert.NoError(t, err)
+		tagged, err := MarshalJSON(&Options{}, c.tagged)
+		assert.NoError(t, err)
+		assert.JSONEq(t, string(tagged), string(compact))
+	}
+
+	// pointers to empty values are output, structs of empty values are not
+	verifyOutputGivenOptions(t, TestOmitEmptyOptionModel{Ptr: &empty, ChildPtr: &OmitEmptyOptionChild{}}, &Options{OmitEmpty: true}, `{"ptr":""}`)
+	verifyOutputGivenOptions(t, TestOmitEmptyOptionModel{}, &Options{}, `{"string":"","int":0,"slice":null,"ptr":null,"child":{"value":""},"child_ptr":null}`)
+}
+
+type KeepEmptyChild struct {
+	Value string `json:"value,keepempty"`
+}
+
+type TestKeepEmptyModel struct {
+	Count    int            `json:"count,keepempty"`
+	Name     string         `json:"name"`
+	Child    KeepEmptyChild `json:"child"`
+	Explicit string         `json:"explicit,omitempty,keepempty"`
+}
+
+type KeepEmptyEmbedded struct {
+	Keep  string `json:"keep,keepempty"`
+	Empty string `json:"empty"`
+}
+
+type TestKeepEmptyEmbeddingModel struct {
+	KeepEmptyEmbedded
+	Name string `json:"name"`
+}
+
+type TestKeepEmptyOmittedEmbeddingModel struct {
+	KeepEmptyEmbedded `json:",omitempty"`
+	Name              string `json:"name"`
+}
+
+func TestMarshal_OmitEmptyKeepEmptyEmbedded(t *testing.T) {
+	// promoted fields keep their own keepempty option, unless the embedded struct is explicitly omitempty
+	verifyOutputGivenOptions(t, TestKeepEmptyEmbeddingModel{}, &Options{OmitEmpty: true}, `{"keep":""}`)
+	verifyOutputGivenOptions(t, TestKeepEmptyOmittedEmbeddingModel{}, &Options{OmitEmpty: true}, `{}`)
+	verifyOutputGivenOptions(t, TestKeepEmptyOmittedEmbeddingModel{}, &Options{}, `{"name":""}`)
+}
+
+func TestMarshal_OmitEmptyKeepEmpty(t *testing.T) {
+	// fields with keepempty opt out of Options.OmitEmpty, so structs containing them aren't empty either,
+	// while their own omitempty option still applies
+	verifyOutputGivenOptions(t, TestKeepEmptyModel{}, &Options{OmitEmpty: true}, `{"count":0,"child":{"value":""}}`)
+	verifyOutputGivenOptions(t, TestKeepEmptyModel{}, &Options{}, `{"count":0,"name":"","child":{"value":""}}`)
+}
+
+type MaxDepthNode struct {
+	Name     string          `json:"name"`
+	Child    *MaxDepthNode   `json:"child,omitempty"`
+	Children []*MaxDepthNode `json:"children,omitempty"`
+}
+
+type MaxDepthEmbedding struct {
+	MaxDepthNode
+	Extra string `json:"extra"`
+}
+
+func TestMarshal_MaxDepth(t *testing.T) {
+	root := &MaxDepthNode{Name: "root"}
+	node := root
+	for i := 0; i < 9; i++ {
+		node.Child = &MaxDepthNode{Name: "child"}
+		node = node.Child
+	}
+
+	_, err := Marshal(&Options{MaxDepth: 5}, root)
+	assert.Equal(t, MaxDepthError{MaxDepth: 5}, err)
+	assert.Equal(t, "marshaller: Maximum depth of 5 exceeded.", err.Error())
+
+	_, err = Marshal(&Options{MaxDepth: 10}, root)
+	assert.NoError(t, err)
+	_, err = Marshal(&Options{}, root)
+	assert.NoError(t, err)
+
+	// slices count as a level
+	nested := MaxDepthNode{Name: "root", Children: []*MaxDepthNode{{Name: "child"}}}
+	verifyOutputGivenOptions(t, nested, &Options{MaxDepth: 3}, `{"name":"root","children":[{"name":"child"}]}`)
+	_, err = Marshal(&Options{MaxDepth: 2}, nested)
+	assert.IsType(t, MaxDepthError{}, err)
+
+	// embedded structs don't
+	verifyOutputGivenOptions(t, MaxDepthEmbedding{MaxDepthNode: MaxDepthNode{Name: "embedded"}, Extra: "extra"}, &Options{MaxDepth: 1}, `{"name":"embedded","extra":"extra"}`)
+
+	var buf bytes.Buffer
+	err = NewEncoder(&buf, &Options{MaxDepth: 5}).Encode(root)
+	assert.IsType(t, MaxDepthError{}, err)
+}
+
+func TestMarshal_MaxDepthBoundary(t *testing.T) {
+	// 10 nested structs
+	root := &MaxDepthNode{Name: "root"}
+	node := root
+	for i := 0; i < 9; i++ {
+		node.Child = &MaxDepthNode{Name: "child"}
+		node = node.Child
+	}
+	_, err := Marshal(&Options{MaxDepth: 10}, root)
+	assert.NoError(t, err)
+	_, err = Marshal(&Options{MaxDepth: 9}, root)
+	assert.Equal(t, MaxDepthError{MaxDepth: 9}, err)
+
+	// user supplied shapes, e.g. decoded JSON, are limited as well
+	var deep interface{} = "leaf"
+	for i := 0; i < 10000; i++ {
+		deep = map[string]interface{}{"nested": []interface{}{deep}}
+	}
+	_, err = Marshal(&Options{MaxDepth: 20000}, deep)
+	assert.NoError(t, err)
+	_, err = Marshal(&Options{MaxDepth: 19999}, deep)
+	assert.Equal(t, MaxDepthError{MaxDepth: 19999}, err)
+	_, err = Marshal(&Options{MaxDepth: 100}, deep)
+	assert.Equal(t, MaxDepthError{MaxDepth: 100}, err)
+}
+
+type TestMaxDepthHiddenModel struct {
+	Name string        `json:"name" groups:"api"`
+	Deep *MaxDepthNode `json:"deep" groups:"admin"`
+}
+
+func TestMarshal_MaxDepthHidden(t *testing.T) {
+	root := &MaxDepthNode{Name: "root"}
+	node := root
+	for i := 0; i < 9; i++ {
+		node.Child = &MaxDepthNode{Name: "child"}
+		node = node.Child
+	}
+	v := TestMaxDepthHiddenModel{Name: "name", Deep: root}
+
+	// only levels which are output count
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}, InheritGroups: true, MaxDepth: 3}, `{"name":"name"}`)
+	_, err := Marshal(&Options{Groups: []string{"admin"}, InheritGroups: true, MaxDepth: 3}, v)
+	assert.Equal(t, MaxDepthError{MaxDepth: 3}, err)
+}
+
+type ExcludedGroupsChild struct {
+	Value string `json:"value" groups:"api"`
+}
+
+type TestExcludedGroupsModel struct {
+	Public  string              `json:"public" groups:"api"`
+	Secret  string              `json:"secret" groups:"api,secret"`
+	Admin   string              `json:"admin" groups:"admin,secret"`
+	NoGroup string              `json:"no_group"`
+	Child   ExcludedGroupsChild `json:"child" groups:"api,secret"`
+}
+
+func TestMarshal_ExcludedRequestedGroups(t *testing.T) {
+	model := TestExcludedGroupsModel{
+		Public:  "public",
+		Secret:  "secret",
+		Admin:   "admin",
+		NoGroup: "no_group",
+		Child:   ExcludedGroupsChild{Value: "value"},
+	}
+
+	verifyOutputGivenOptions(t, model, &Options{Groups: []string{"api"}}, `{"public":"public","secret":"secret","child":{"value":"value"}}`)
+	verifyOutputGivenOptions(t, model, &Options{Groups: []string{"api", "-secret"}}, `{"public":"public"}`)
+	verifyOutputGivenOptions(t, model, &Options{Groups: []string{"api", "admin", "-secret"}}, `{"public":"public"}`)
+	verifyOutputGivenOptions(t, model, &Options{Groups: []string{"*", "-secret"}}, `{"public":"public"}`)
+	verifyOutputGivenOptions(t, model, &Options{Groups: []string{"-secret"}, OutputFieldsWithNoGroup: true}, `{"no_group":"no_group"}`)
+	// excluding a group which isn't part of a field has no effect
+	verifyOutputGivenOptions(t, model, &Options{Groups: []string{"admin", "-api"}}, `{"admin":"admin"}`)
+	verifyOutputGivenOptions(t, model, &Options{Groups: []string{"api", "-admin"}}, `{"public":"public","secret":"secret","child":{"value":"value"}}`)
+}
+
+func TestMarshalMap(t *testing.T) {
+	v := TestGroupsModel{
+		DefaultMarshal: "DefaultMarshal",
+		OnlyGroupTest:  "OnlyGroupTest",
+	}
+	expected := map[string]interface{}{
+		"only_group_test":      "OnlyGroupTest",
+		"group_test_and_other": "",
+	}
+
+	actual, err := MarshalMap(&Options{Groups: []string{"test"}}, v)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actual)
+
+	actual, err = MarshalMap(&Options{Groups: []string{"test"}}, &v)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actual)
+
+	actual, err = MarshalMap(&Options{Groups: []string{"test"}, PreserveOrder: true}, v)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actual)
+
+	_, err = MarshalMap(&Options{}, []string{"not", "a", "struct"})
+	assert.Equal(t, MarshalInvalidTypeError{t: reflect.Slice, data: []string{"not", "a", "struct"}}, err)
+
+	_, err = MarshalMap(&Options{}, (*TestGroupsModel)(nil))
+	assert.IsType(t, MarshalInvalidTypeError{}, err)
+}
+
+func TestMarshalSlice(t *testing.T) {
+	models := []TestGroupsModel{
+		{OnlyGroupTest: "first", OnlyGroupTestOther: "other"},
+		{OnlyGroupTest: "second"},
+	}
+
+	elems, err := MarshalSlice(&Options{Groups: []string{"test"}}, models)
+	assert.NoError(t, err)
+	assert.Len(t, elems, 2)
+	assert.Equal(t, "first", elems[0].(map[string]interface{})["only_group_test"])
+	assert.NotContains(t, elems[0], "only_group_test_other")
+
+	elems, err = MarshalSlice(&Options{Groups: []string{"test"}}, &[1]TestGroupsModel{{OnlyGroupTest: "array"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "array", elems[0].(map[string]interface{})["only_group_test"])
+
+	elems, err = MarshalSlice(&Options{}, []TestGroupsModel(nil))
+	assert.NoError(t, err)
+	assert.Nil(t, elems)
+
+	_, err = MarshalSlice(&Options{}, TestGroupsModel{})
+	assert.IsType(t, MarshalInvalidTypeError{}, err)
+	_, err = MarshalSlice(&Options{}, []byte("bytes"))
+	assert.IsType(t, MarshalInvalidTypeError{}, err)
+}
+
+func TestMarshalSlice_Invalid(t *testing.T) {
+	elems, err := MarshalSlice(&Options{}, []TestGroupsModel{})
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{}, elems)
+
+	for _, data := range []interface{}{nil, (*[]TestGroupsModel)(nil), "string", map[string]TestGroupsModel{}} {
+		_, err := MarshalSlice(&Options{}, data)
+		assert.IsType(t, MarshalInvalidTypeError{}, err, "%#v", data)
+	}
+}
+
+func TestMarshal_TopLevelMap(t *testing.T) {
+	models := map[string]TestGroupsModel{
+		"first":  {OnlyGroupTest: "first", OnlyGroupTestOther: "other"},
+		"second": {OnlyGroupTestOther: "other"},
+	}
+
+	verifyOutputGivenOptions(t, models, &Options{Groups: []string{"test"}}, `{
+		"first": {"only_group_test":"first","group_test_and_other":""},
+		"second": {"only_group_test":"","group_test_and_other":""}
+	}`)
+	verifyOutputGivenOptions(t, &map[string]*AModel{"model": {true, true}}, &Options{Groups: []string{"test-other"}}, `{"model":{"something_else":true}}`)
+}
+
+type TestInvertedVersionRangeModel struct {
+	Valid    string `json:"valid" since:"2.0.0" until:"3.0.0"`
+	Inverted string `json:"inverted" since:"3.0.0" until:"2.0.0"`
+}
+
+type TestInvertedBetweenModel struct {
+	Inverted string `json:"inverted" between:"3.0.0,2.0.0"`
+}
+
+func TestMarshal_StrictTags(t *testing.T) {
+	v := TestInvertedVersionRangeModel{Valid: "valid", Inverted: "inverted"}
+
+	// the inverted field is silently omitted for every version without StrictTags
+	for _, apiVersion := range []string{"1.0.0", "2.5.0", "4.0.0"} {
+		_, err := Marshal(&Options{ApiVersion: version.Must(version.NewVersion(apiVersion))}, v)
+		assert.NoError(t, err)
+	}
+	verifyOutputGivenOptions(t, v, &Options{ApiVersion: version.Must(version.NewVersion("2.5.0"))}, `{"valid":"valid"}`)
+
+	_, err := Marshal(&Options{StrictTags: true, ApiVersion: version.Must(version.NewVersion("2.5.0"))}, v)
+	assert.Equal(t, InvertedVersionRangeError{Field: "TestInvertedVersionRangeModel.Inverted", Since: "3.0.0", Until: "2.0.0"}, err)
+	assert.Equal(t, "marshaller: Field TestInvertedVersionRangeModel.Inverted is never available since version 3.0.0 is greater than until version 2.0.0.", err.Error())
+	// tags are validated regardless of the API version
+	_, err = Marshal(&Options{StrictTags: true}, v)
+	assert.IsType(t, InvertedVersionRangeError{}, err)
+
+	_, err = Marshal(&Options{StrictTags: true}, TestInvertedBetweenModel{})
+	assert.Equal(t, InvertedVersionRangeError{Field: "TestInvertedBetweenModel.Inverted", Since: "3.0.0", Until: "2.0.0"}, err)
+
+	_, err = Marshal(&Options{StrictTags: true}, TestVersionsModel{})
+	assert.NoError(t, err)
+}
+
+type TestUnsupportedModel struct {
+	Name      string        `json:"name"`
+	Channel   chan int      `json:"channel"`
+	Callback  func() string `json:"callback"`
+	Callbacks []func()      `json:"callbacks"`
+	Any       interface{}   `json:"any"`
+}
+
+func TestMarshal_Unsupported(t *testing.T) {
+	v := TestUnsupportedModel{
+		Name:      "name",
+		Channel:   make(chan int),
+		Callback:  func() string { return "callback" },
+		Callbacks: []func(){func() {}},
+		Any:       func() {},
+	}
+
+	// like encoding/json, unsupported fields are skipped by default
+	verifyOutputGivenOptions(t, v, &Options{}, `{"name":"name","callbacks":[null],"any":null}`)
+	verifyOutputGivenOptions(t, TestUnsupportedModel{Name: "name"}, &Options{}, `{"name":"name","callbacks":null,"any":null}`)
+
+	o := &Options{RejectUnsupported: true}
+	_, err := Marshal(o, v)
+	assert.IsType(t, MarshalInvalidTypeError{}, err)
+	assert.Equal(t, "TestUnsupportedModel.Channel", err.(MarshalInvalidTypeError).Path)
+	_, err = Marshal(o, TestUnsupportedModel{Callbacks: []func(){nil}})
+	assert.Equal(t, "TestUnsupportedModel.Channel", err.(MarshalInvalidTypeError).Path)
+	_, err = Marshal(o, struct {
+		Callbacks []func() `json:"callbacks"`
+	}{[]func(){nil}})
+	assert.Equal(t, ".Callbacks[0]", err.(MarshalInvalidTypeError).Path)
+
+	exposure, err := FieldExposure(reflect.TypeOf(v), &Options{Groups: []string{"api"}, OutputFieldsWithNoGroup: true})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"name": {"api"}, "callbacks": {"api"}, "any": {"api"}}, exposure)
+}
+
+type WildcardTagChild struct {
+	Value  string `json:"value"`
+	Hidden string `json:"hidden" groups:"hidden"`
+}
+
+type TestWildcardTagModel struct {
+	ID     string           `json:"id" groups:"*"`
+	Name   string           `json:"name" groups:"api"`
+	Secret string           `json:"secret" groups:"*" exclude_groups:"public"`
+	Child  WildcardTagChild `json:"child" groups:"*"`
+}
+
+func TestMarshal_WildcardTag(t *testing.T) {
+	v := TestWildcardTagModel{ID: "id", Name: "name", Secret: "secret", Child: WildcardTagChild{Value: "value", Hidden: "hidden"}}
+
+	for _, groups := range [][]string{{"api"}, {"other"}, {"api", "other"}} {
+		d, err := Marshal(&Options{Groups: groups, MatchAllGroups: true}, v)
+		assert.NoError(t, err)
+		assert.Equal(t, "id", d.(map[string]interface{})["id"])
+	}
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}}, `{"id":"id","name":"name","secret":"secret","child":{}}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"other"}}, `{"id":"id","secret":"secret","child":{}}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"public"}}, `{"id":"id","child":{}}`)
+	verifyOutputGivenOptions(t, v, &Options{}, `{"id":"id","name":"name","secret":"secret","child":{"value":"value","hidden":"hidden"}}`)
+	verifyOutputGivenOptions(t, v, &Options{OutputFieldsWithNoGroup: true}, `{"id":"id","secret":"secret","child":{"value":"value"}}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"other"}, InheritGroups: true}, `{"id":"id","secret":"secret","child":{"value":"value","hidden":"hidden"}}`)
+}
+
+type SelectedFieldsChild struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type SelectedFieldsEmbedded struct {
+	Embedded string `json:"embedded"`
+}
+
+type TestSelectedFieldsModel struct {
+	SelectedFieldsEmbedded
+	ID     string              `json:"id"`
+	Name   string              `json:"name" alias:"api=title"`
+	Secret string              `json:"secret" groups:"admin"`
+	Child  SelectedFieldsChild `json:"child"`
+}
+
+func TestMarshal_SelectedFields(t *testing.T) {
+	v := TestSelectedFieldsModel{
+		SelectedFieldsEmbedded: SelectedFieldsEmbedded{Embedded: "embedded"},
+		ID:                     "id",
+		Name:                   "name",
+		Secret:                 "secret",
+		Child:                  SelectedFieldsChild{ID: "child_id", Name: "child_name"},
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{OnlyFields: []string{"id", "child"}}, `{"id":"id","child":{"id":"child_id","name":"child_name"}}`)
+	verifyOutputGivenOptions(t, v, &Options{OnlyFields: []string{"embedded"}}, `{"embedded":"embedded"}`)
+	verifyOutputGivenOptions(t, v, &Options{ExcludeFields: []string{"id", "embedded"}}, `{"name":"name","secret":"secret","child":{"id":"child_id","name":"child_name"}}`)
+	// exclusion takes precedence
+	verifyOutputGivenOptions(t, v, &Options{OnlyFields: []string{"id", "name"}, ExcludeFields: []string{"id"}}, `{"name":"name"}`)
+	// names of the json tag are used, aliases are applied afterwards
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}, OutputFieldsWithNoGroup: true, OnlyFields: []string{"name", "title"}}, `{"title":"name"}`)
+	// groups are still checked
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}, OnlyFields: []string{"secret"}}, `{}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"admin"}, OnlyFields: []string{"secret"}}, `{"secret":"secret"}`)
+	// nested structs and slice elements aren't affected
+	verifyOutputGivenOptions(t, []SelectedFieldsChild{{ID: "id", Name: "name"}}, &Options{OnlyFields: []string{"id"}}, `[{"id":"id","name":"name"}]`)
+}
+
+type InlineAddress struct {
+	Street string `json:"street"`
+	City   string `json:"city" groups:"public"`
+}
+
+type InlineName struct {
+	Name string `json:"name"`
+}
+
+type TestInlineModel struct {
+	Name    string        `json:"name" groups:"public"`
+	Home    InlineAddress `json:",inline" groups:"private"`
+	Company *InlineName   `json:"company,inline" groups:"public"`
+}
+
+func TestMarshal_Inline(t *testing.T) {
+	v := TestInlineModel{
+		Name:    "name",
+		Home:    InlineAddress{Street: "street", City: "city"},
+		Company: &InlineName{Name: "company"},
+	}
+
+	// keys are merged and shadowed like those of embedded structs
+	verifyOutputGivenOptions(t, v, &Options{}, `{"name":"name","street":"street","city":"city"}`)
+	// groups are passed on to fields without groups like those of embedded structs
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"private"}}, `{"street":"street"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"public"}}, `{"name":"name","city":"city"}`)
+
+	var decoded TestInlineModel
+	err := Unmarshal(&Options{Groups: []string{"private"}}, map[string]interface{}{"street": "street"}, &decoded)
+	assert.NoError(t, err)
+	assert.Equal(t, InlineAddress{Street: "street"}, decoded.Home)
+
+	exposure, err := FieldExposure(reflect.TypeOf(TestInlineModel{}), &Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"name": {"public"}, "street": {"private"}, "city": {"public"}}, exposure)
+}
+
+type TaggedEmbedded struct {
+	Value string `json:"value" since:"2.0.0"`
+}
+
+type TestHasSheriffTagsModel struct {
+	*TaggedEmbedded
+	Name string `json:"name"`
+}
+
+func TestHasSheriffTags(t *testing.T) {
+	assert.False(t, HasSheriffTags(reflect.TypeOf(BenchmarkModel{})))
+	assert.False(t, HasSheriffTags(reflect.TypeOf(&SubModel{})))
+	assert.False(t, HasSheriffTags(reflect.TypeOf("string")))
+	assert.True(t, HasSheriffTags(reflect.TypeOf(TestGroupsModel{})))
+	assert.True(t, HasSheriffTags(reflect.TypeOf(TestTimeFormatModel{})))
+	assert.True(t, HasSheriffTags(reflect.TypeOf(TestHasSheriffTagsModel{})))
+
+	// untagged fields are output like before
+	v := BenchmarkModel{AString: "str", ASubModel: SubModel{AnotherString: "str"}}
+	expected, err := json.Marshal(v)
+	assert.NoError(t, err)
+	for _, options := range []*Options{
+		{},
+		{Groups: []string{"api"}, OutputFieldsWithNoGroup: true, ApiVersion: version.Must(version.NewVersion("1.0.0"))},
+		{InheritGroups: true, OutputFieldsWithNoGroup: true},
+	} {
+		verifyOutputGivenOptions(t, v, options, string(expected))
+	}
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}}, `{}`)
+	verifyOutputGivenOptions(t, SubModel{}, &Options{Groups: []string{"api"}, OutputFieldsWithNoGroup: true, DefaultGroup: "default"}, `{}`)
+}
+
+type TestInvalidVersionTagModel struct {
+	CreatedAt string `json:"created_at" since:"invalid"`
+}
+
+func TestMarshal_InvalidVersionTag(t *testing.T) {
+	options := &Options{ApiVersion: version.Must(version.NewVersion("1.0.0"))}
+
+	_, err := Marshal(options, TestInvalidVersionTagModel{})
+	assert.IsType(t, InvalidVersionTagError{}, err)
+	assert.Equal(t, "TestInvalidVersionTagModel.CreatedAt", err.(InvalidVersionTagError).Field)
+	assert.Equal(t, "since", err.(InvalidVersionTagError).Tag)
+	assert.Contains(t, err.Error(), "marshaller: Invalid version in since tag of field TestInvalidVersionTagModel.CreatedAt: ")
+
+	_, err = Marshal(&Options{ApiVersion: options.ApiVersion, UntilTagName: "deprecated"}, struct {
+		Name string `deprecated:"2.x"`
+	}{})
+	assert.Equal(t, "deprecated", err.(InvalidVersionTagError).Tag)
+	assert.Equal(t, ".Name", err.(InvalidVersionTagError).Field)
+
+	_, err = Marshal(options, struct {
+		Name string `version:">=1.0.0 || invalid"`
+	}{})
+	assert.Equal(t, "version", err.(InvalidVersionTagError).Tag)
+}
+
+type TestGroupSeparatorModel struct {
+	Team    string `json:"team" groups:"org\\,team,admin"`
+	Org     string `json:"org" groups:"org"`
+	Escaped string `json:"escaped" groups:"a\\b"`
+	Piped   string `json:"piped" pipe_groups:"org,team|admin" alias:"org,team=team_alias"`
+}
+
+func TestMarshal_GroupSeparator(t *testing.T) {
+	v := TestGroupSeparatorModel{Team: "team", Org: "org", Escaped: "escaped", Piped: "piped"}
+
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"org,team"}}, `{"team":"team"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"org"}}, `{"org":"org"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"admin"}}, `{"team":"team"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"a\\b"}}, `{"escaped":"escaped"}`)
+
+	options := &Options{GroupTagName: "pipe_groups", GroupSeparator: "|"}
+	options.Groups = []string{"org,team"}
+	verifyOutputGivenOptions(t, v, options, `{"team_alias":"piped"}`)
+	options.Groups = []string{"admin"}
+	verifyOutputGivenOptions(t, v, options, `{"piped":"piped"}`)
+	options.Groups = []string{"org"}
+	verifyOutputGivenOptions(t, v, options, `{}`)
+}
+
+func TestSplitGroups(t *testing.T) {
+	assert.Equal(t, []string{"a", "b"}, splitGroups("a,b", ","))
+	assert.Equal(t, []string{"a,b", "c"}, splitGroups(`a\,b,c`, ","))
+	assert.Equal(t, []string{"a,b,c"}, splitGroups(`a\,b\,c`, ","))
+	assert.Equal(t, []string{"a", ""}, splitGroups("a,", ","))
+	assert.Equal(t, []string{"a|b", "c"}, splitGroups(`a\|b|c`, "|"))
+	assert.Equal(t, []string{"a", "b"}, splitGroups("a::b", "::"))
+}
+
+type TestPointerToPointerModel struct {
+	Model     **AModel    `json:"model"`
+	Int       **int       `json:"int"`
+	Nil       **AModel    `json:"nil"`
+	NilInner  **AModel    `json:"nil_inner"`
+	Time      **time.Time `json:"time"`
+	Interface interface{} `json:"interface"`
+	Slice     []**AModel  `json:"slice"`
+}
+
+func TestMarshal_PointerToPointer(t *testing.T) {
+	model := &AModel{AllGroups: true, TestGroup: true}
+	i := 42
+	ip := &i
+	var nilModel *AModel
+	ts := &time.Time{}
+	v := TestPointerToPointerModel{
+		Model:     &model,
+		Int:       &ip,
+		NilInner:  &nilModel,
+		Time:      &ts,
+		Interface: &ip,
+		Slice:     []**AModel{&model, &nilModel},
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"test"}, OutputFieldsWithNoGroup: true}, `{
+		"model": {"something": true},
+		"int": 42,
+		"nil": null,
+		"nil_inner": null,
+		"time": "0001-01-01T00:00:00Z",
+		"interface": 42,
+		"slice": [{"something": true}, null]
+	}`)
+	verifyOutputGivenOptions(t, &model, &Options{Groups: []string{"test-other"}}, `{"something_else": true}`)
+}
+
+func TestMarshal_PointerToPointerEncoder(t *testing.T) {
+	model := &AModel{AllGroups: true}
+	modelPtr := &model
+	var nilModel *AModel
+	nilModelPtr := &nilModel
+	v := map[string]interface{}{
+		"model":     &modelPtr,
+		"nil_inner": &nilModelPtr,
+		"nil":       (***AModel)(nil),
+	}
+	expected := `{"model":{"something":true},"nil_inner":null,"nil":null}`
+
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"test"}}, expected)
+	var buf bytes.Buffer
+	assert.NoError(t, NewEncoder(&buf, &Options{Groups: []string{"test"}}).Encode(v))
+	assert.JSONEq(t, expected, buf.String())
+}
+
+func TestMarshal_Concurrent(t *testing.T) {
+	v := TestInlineModel{
+		Name:    "name",
+		Home:    InlineAddress{Street: "street", City: "city"},
+		Company: &InlineName{Name: "company"},
+	}
+	items := []TestWildcardModel{{
+		Grouped:   "grouped",
+		Ungrouped: "ungrouped",
+		Inherited: HalfTagged{WithTag: "with_tag", WithoutTag: "without_tag"},
+	}}
+	options := &Options{
+		Groups:          []string{"public", "a"},
+		InheritGroups:   true,
+		MaxInheritDepth: 2,
+		ApiVersion:      version.Must(version.NewVersion("1.0.0")),
+		PreserveOrder:   true,
+	}
+	data := []interface{}{v, &v, items}
+
+	expected, err := MarshalJSON(options, data)
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	results := make([][]byte, 100)
+	errs := make([]error, len(results))
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = MarshalJSON(options, data)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range results {
+		assert.NoError(t, errs[i])
+		assert.Equal(t, string(expected), string(results[i]))
+	}
+}
+
+type AdditiveGroupsBase struct {
+	ID      string `json:"id" groups:"api"`
+	Secret  string `json:"secret" groups:"admin"`
+	NoGroup string `json:"no_group"`
+}
+
+type AdditiveGroupsNested struct {
+	Value string `json:"value" groups:"detail"`
+}
+
+type TestAdditiveGroupsModel struct {
+	AdditiveGroupsBase `groups:"+audit"`
+	Name               string               `json:"name" groups:"api"`
+	Nested             AdditiveGroupsNested `json:"nested" groups:"+audit"`
+}
+
+func TestMarshal_AdditiveGroups(t *testing.T) {
+	v := TestAdditiveGroupsModel{
+		AdditiveGroupsBase: AdditiveGroupsBase{ID: "id", Secret: "secret", NoGroup: "no_group"},
+		Name:               "name",
+		Nested:             AdditiveGroupsNested{Value: "value"},
+	}
+
+	// the fields of the embedded struct keep their own groups
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}}, `{"id":"id","name":"name"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"admin"}}, `{"secret":"secret"}`)
+	// and have the additive groups in addition
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"audit"}}, `{"id":"id","secret":"secret","no_group":"no_group","nested":{}}`)
+	// additive groups of nested structs only apply with InheritGroups
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"audit"}, InheritGroups: true}, `{"id":"id","secret":"secret","no_group":"no_group","nested":{"value":"value"}}`)
+	// a field with additive groups has them as its own groups as well
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"detail"}, InheritGroups: true}, `{}`)
+	// negated and excluded groups still apply
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"audit", "-admin"}}, `{"id":"id","no_group":"no_group","nested":{}}`)
+
+	exposure, err := FieldExposure(reflect.TypeOf(v), &Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"admin", "audit"}, exposure["secret"])
+
+	// the markers of additive groups aren't exposed as inherited groups
+	parents := groupSet{"audit": 1, "+audit": 1, "api": 0}
+	assert.Equal(t, []string{"audit"}, parents.groups())
+	assert.Equal(t, []string{"audit"}, parents.additiveGroups())
+}
+
+type InheritedMapValue struct {
+	Untagged string `json:"untagged"`
+	Tagged   string `json:"tagged" groups:"admin"`
+}
+
+type TestInheritedMapModel struct {
+	ByName   map[string]InheritedMapValue   `json:"by_name" groups:"detail"`
+	ByID     map[int]*InheritedMapValue     `json:"by_id" groups:"detail"`
+	Nested   map[string][]InheritedMapValue `json:"nested" groups:"detail"`
+	Untagged map[string]InheritedMapValue   `json:"untagged"`
+}
+
+func TestMarshal_InheritGroupsMapValues(t *testing.T) {
+	value := InheritedMapValue{Untagged: "untagged", Tagged: "tagged"}
+	v := TestInheritedMapModel{
+		ByName:   map[string]InheritedMapValue{"a": value},
+		ByID:     map[int]*InheritedMapValue{1: &value},
+		Nested:   map[string][]InheritedMapValue{"a": {value}},
+		Untagged: map[string]InheritedMapValue{"a": value},
+	}
+
+	// the groups of a map field are inherited by the fields of its struct values
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"detail"}, InheritGroups: true}, `{
+		"by_name": {"a": {"untagged": "untagged", "tagged": "tagged"}},
+		"by_id": {"1": {"untagged": "untagged", "tagged": "tagged"}},
+		"nested": {"a": [{"untagged": "untagged", "tagged": "tagged"}]}
+	}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"detail", "admin"}, InheritGroups: true, OutputFieldsWithNoGroup: true}, `{
+		"by_name": {"a": {"untagged": "untagged", "tagged": "tagged"}},
+		"by_id": {"1": {"untagged": "untagged", "tagged": "tagged"}},
+		"nested": {"a": [{"untagged": "untagged", "tagged": "tagged"}]},
+		"untagged": {"a": {"untagged": "untagged", "tagged": "tagged"}}
+	}`)
+	// without InheritGroups, the fields of the values are matched on their own
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"detail"}}, `{
+		"by_name": {"a": {}},
+		"by_id": {"1": {}},
+		"nested": {"a": [{}]}
+	}`)
+	// the depth of inherited groups counts the struct values, not the map
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"detail"}, InheritGroups: true, MaxInheritDepth: 1}, `{
+		"by_name": {"a": {"untagged": "untagged", "tagged": "tagged"}},
+		"by_id": {"1": {"untagged": "untagged", "tagged": "tagged"}},
+		"nested": {"a": [{"untagged": "untagged", "tagged": "tagged"}]}
+	}`)
+}
+
+type DebugGroupsChild struct {
+	Untagged string `json:"untagged"`
+	Tagged   string `json:"tagged" groups:"admin"`
+}
+
+type TestDebugGroupsModel struct {
+	Name    string           `json:"name" groups:"api,detail"`
+	Email   string           `json:"email" groups:"detail"`
+	Hidden  string           `json:"hidden" groups:"internal"`
+	NoGroup string           `json:"no_group"`
+	Child   DebugGroupsChild `json:"child" groups:"detail"`
+}
+
+func TestMarshalDebug(t *testing.T) {
+	v := TestDebugGroupsModel{Name: "name", Email: "email", Hidden: "hidden", NoGroup: "no_group", Child: DebugGroupsChild{Untagged: "untagged", Tagged: "tagged"}}
+	options := &Options{Groups: []string{"detail", "api"}, InheritGroups: true, OutputFieldsWithNoGroup: true}
+
+	data, matched, err := MarshalDebug(options, v)
+	assert.NoError(t, err)
+	expected, err := Marshal(options, v)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, data)
+	assert.Equal(t, map[string]string{
+		"TestDebugGroupsModel.Name":  "detail",
+		"TestDebugGroupsModel.Email": "detail",
+		"TestDebugGroupsModel.Child": "detail",
+		"DebugGroupsChild.Untagged":  "detail",
+		"DebugGroupsChild.Tagged":    "detail",
+	}, matched)
+
+	// the group listed first is used
+	_, matched, err = MarshalDebug(&Options{Groups: []string{"api", "detail"}}, v)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"TestDebugGroupsModel.Name":  "api",
+		"TestDebugGroupsModel.Email": "detail",
+		"TestDebugGroupsModel.Child": "detail",
+	}, matched)
+
+	_, matched, err = MarshalDebug(&Options{Groups: []string{"*"}}, v)
+	assert.NoError(t, err)
+	assert.Len(t, matched, 5)
+	assert.Equal(t, "*", matched["DebugGroupsChild.Tagged"])
+
+	_, matched, err = MarshalDebug(&Options{}, v)
+	assert.NoError(t, err)
+	assert.Empty(t, matched)
+	assert.Nil(t, options.debugGroups)
+}
+
+type DebugHiddenParentChild struct {
+	Name string `json:"name" groups:"api"`
+}
+
+type TestDebugHiddenParentModel struct {
+	Name  string                 `json:"name" groups:"api"`
+	Child DebugHiddenParentChild `json:"child" groups:"admin"`
+}
+
+func TestMarshalDebug_HiddenParent(t *testing.T) {
+	v := TestDebugHiddenParentModel{Name: "name", Child: DebugHiddenParentChild{Name: "child"}}
+
+	// the fields of a hidden struct aren't output, even if their own groups match
+	data, matched, err := MarshalDebug(&Options{Groups: []string{"api"}}, v)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "name"}, data)
+	assert.Equal(t, map[string]string{"TestDebugHiddenParentModel.Name": "api"}, matched)
+}
+
+type TestOmitEmptyDeepModel struct {
+	Nil      *string  `json:"nil,omitempty"`
+	Empty    *string  `json:"empty,omitempty"`
+	EmptyPtr **string `json:"empty_ptr,omitempty"`
+	NotEmpty *string  `json:"not_empty,omitempty"`
+	Zero     *int     `json:"zero,omitempty"`
+	NoOmit   *string  `json:"no_omit"`
+}
+
+func TestMarshal_OmitEmptyDeep(t *testing.T) {
+	empty, notEmpty, zero := "", "value", 0
+	emptyPtr := &empty
+	v := TestOmitEmptyDeepModel{
+		Empty:    &empty,
+		EmptyPtr: &emptyPtr,
+		NotEmpty: &notEmpty,
+		Zero:     &zero,
+		NoOmit:   &empty,
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{}, `{"empty":"","empty_ptr":"","not_empty":"value","zero":0,"no_omit":""}`)
+	verifyOutputGivenOptions(t, v, &Options{OmitEmptyDeep: true}, `{"not_empty":"value","no_omit":""}`)
+	verifyOutputGivenOptions(t, v, &Options{OmitEmpty: true, OmitEmptyDeep: true}, `{"not_empty":"value"}`)
+}
+
+type TestKnownGroupsChild struct {
+	Name string `json:"name" groups:"api,admn"`
+}
+
+type TestKnownGroupsModel struct {
+	Username string               `json:"username" groups:"api,!public"`
+	Email    string               `json:"email" groups_omitempty:"admin" exclude_groups:"public"`
+	Any      string               `json:"any" groups:"*"`
+	Child    TestKnownGroupsChild `json:"child" groups:"api"`
+}
+
+func TestMarshal_KnownGroups(t *testing.T) {
+	v := TestKnownGroupsModel{Username: "user", Email: "email", Any: "any", Child: TestKnownGroupsChild{Name: "name"}}
+	known := []string{"api", "admin", "public"}
+
+	// the typo only hides the field without StrictTags
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"admin"}, KnownGroups: known}, `{"email":"email","any":"any"}`)
+	_, err := Marshal(&Options{Groups: []string{"api"}, StrictTags: true}, v)
+	assert.NoError(t, err)
+
+	_, err = Marshal(&Options{Groups: []string{"api"}, StrictTags: true, KnownGroups: known}, v)
+	assert.Equal(t, UnknownGroupError{Field: "TestKnownGroupsChild.Name", Group: "admn"}, err)
+	assert.Equal(t, "marshaller: Field TestKnownGroupsChild.Name has unknown group admn.", err.Error())
+
+	_, err = Marshal(&Options{Groups: []string{"api"}, StrictTags: true, KnownGroups: []string{"api", "admin"}}, v)
+	assert.Equal(t, UnknownGroupError{Field: "TestKnownGroupsModel.Username", Group: "public"}, err)
+
+	_, err = Marshal(&Options{Groups: []string{"api"}, StrictTags: true, KnownGroups: append(known, "admn")}, v)
+	assert.NoError(t, err)
+}
+
+type TestFieldFilterChild struct {
+	Salary int `json:"salary" groups:"api"`
+}
+
+type TestFieldFilterModel struct {
+	TestFieldFilterChild
+	Name    string               `json:"name" groups:"api"`
+	Salary  int                  `json:"salary_total" groups:"api" visible:"managers"`
+	Hidden  string               `json:"hidden" groups:"admin"`
+	Nested  TestFieldFilterChild `json:"nested" groups:"api"`
+	Pointer *string              `json:"pointer" groups:"api"`
+}
+
+type testViewerKey struct{}
+
+func TestMarshal_FieldFilter(t *testing.T) {
+	v := TestFieldFilterModel{
+		TestFieldFilterChild: TestFieldFilterChild{Salary: 1},
+		Name:                 "name",
+		Salary:               2,
+		Hidden:               "hidden",
+		Nested:               TestFieldFilterChild{Salary: 3},
+	}
+
+	var called []string
+	options := &Options{Groups: []string{"api"}, FieldFilter: func(field FieldInfo) bool {
+		called = append(called, field.Parent.Type().Name()+"."+field.Field.Name)
+		isManager, _ := field.Context.Value(testViewerKey{}).(bool)
+		return isManager || (field.Name != "salary" && field.Field.Tag.Get("visible") != "managers")
+	}}
+
+	verifyOutputGivenOptions(t, v, options, `{"name":"name","nested":{},"pointer":null}`)
+	// only fields which would be output otherwise are passed, before marshalling their values,
+	// and embedded structs only by their promoted fields
+	assert.Equal(t, []string{
+		"TestFieldFilterChild.Salary",
+		"TestFieldFilterModel.Name",
+		"TestFieldFilterModel.Salary",
+		"TestFieldFilterModel.Nested",
+		"TestFieldFilterChild.Salary",
+		"TestFieldFilterModel.Pointer",
+	}, called)
+
+	actual, err := MarshalContext(context.WithValue(context.Background(), testViewerKey{}, true), options, v)
+	assert.NoError(t, err)
+	actualJSON, err := json.Marshal(actual)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"salary":1,"name":"name","salary_total":2,"nested":{"salary":3},"pointer":null}`, string(actualJSON))
+}
+
+type TestEmbeddedOmitEmptyBase struct {
+	ID    int      `json:"id"`
+	Tags  []string `json:"tags"`
+	Valid bool     `json:"valid"`
+}
+
+type TestEmbeddedOmitEmptyPtrBase struct {
+	Ref string `json:"ref"`
+}
+
+type TestEmbeddedOmitEmptyModel struct {
+	TestEmbeddedOmitEmptyBase     `json:",omitempty"`
+	*TestEmbeddedOmitEmptyPtrBase `json:",omitempty"`
+	Name                          string `json:"name"`
+}
+
+type TestEmbeddedNoOmitEmptyModel struct {
+	TestEmbeddedOmitEmptyBase
+	Name string `json:"name"`
+}
+
+func TestMarshal_EmbeddedOmitEmpty(t *testing.T) {
+	verifyOutputGivenOptions(t, TestEmbeddedOmitEmptyModel{}, &Options{}, `{"name":""}`)
+	verifyOutputGivenOptions(t, TestEmbeddedOmitEmptyModel{TestEmbeddedOmitEmptyPtrBase: &TestEmbeddedOmitEmptyPtrBase{}}, &Options{}, `{"name":""}`)
+	verifyOutputGivenOptions(t, TestEmbeddedOmitEmptyModel{
+		TestEmbeddedOmitEmptyBase:    TestEmbeddedOmitEmptyBase{Valid: true},
+		TestEmbeddedOmitEmptyPtrBase: &TestEmbeddedOmitEmptyPtrBase{Ref: "ref"},
+	}, &Options{}, `{"id":0,"tags":null,"valid":true,"ref":"ref","name":""}`)
+	// an empty but non-nil slice isn't a zero value
+	verifyOutputGivenOptions(t, TestEmbeddedOmitEmptyModel{
+		TestEmbeddedOmitEmptyBase: TestEmbeddedOmitEmptyBase{Tags: []string{}},
+	}, &Options{}, `{"id":0,"tags":[],"valid":false,"name":""}`)
+
+	verifyOutputGivenOptions(t, TestEmbeddedNoOmitEmptyModel{}, &Options{}, `{"id":0,"tags":null,"valid":false,"name":""}`)
+	verifyOutputGivenOptions(t, TestEmbeddedNoOmitEmptyModel{TestEmbeddedOmitEmptyBase: TestEmbeddedOmitEmptyBase{ID: 1}}, &Options{}, `{"id":1,"tags":null,"valid":false,"name":""}`)
+}
+
+type TestOmitNilPointersModel struct {
+	Nil       *string                   `json:"nil"`
+	NotNil    *string                   `json:"not_nil"`
+	NilStruct *TestOmitNilPointersModel `json:"nil_struct"`
+	Zero      string                    `json:"zero"`
+	NilSlice  []string                  `json:"nil_slice"`
+	NilAny    interface{}               `json:"nil_any"`
+}
+
+func TestMarshal_OmitNilPointers(t *testing.T) {
+	empty := ""
+	v := TestOmitNilPointersModel{NotNil: &empty}
+
+	verifyOutputGivenOptions(t, v, &Options{}, `{"nil":null,"not_nil":"","nil_struct":null,"zero":"","nil_slice":null,"nil_any":null}`)
+	verifyOutputGivenOptions(t, v, &Options{OmitNilPointers: true}, `{"not_nil":"","zero":"","nil_slice":null,"nil_any":null}`)
+	verifyOutputGivenOptions(t, []TestOmitNilPointersModel{v}, &Options{OmitNilPointers: true}, `[{"not_nil":"","zero":"","nil_slice":null,"nil_any":null}]`)
+}
+
+func TestMarshal_StrictGroups(t *testing.T) {
+	v := TestKnownGroupsModel{Username: "user", Email: "email"}
+	known := []string{"api", "admin", "public"}
+
+	// unknown groups are only an error with StrictGroups
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"admni"}, KnownGroups: known}, `{"any":""}`)
+
+	for _, groups := range [][]string{{"api"}, {"api", "admin"}, {"*", "-public"}} {
+		_, err := Marshal(&Options{Groups: groups, KnownGroups: known, StrictGroups: true}, v)
+		assert.NoError(t, err, "%v", groups)
+	}
+
+	_, err := Marshal(&Options{Groups: []string{"api", "admni"}, KnownGroups: known, StrictGroups: true}, v)
+	assert.Equal(t, UnknownGroupError{Group: "admni"}, err)
+	assert.Equal(t, "marshaller: Requested group admni is unknown.", err.Error())
+
+	_, err = Marshal(&Options{Groups: []string{"-secret"}, KnownGroups: known, StrictGroups: true}, v)
+	assert.Equal(t, UnknownGroupError{Group: "secret"}, err)
+	_, err = Marshal(&Options{DefaultGroups: []string{"pubilc"}, KnownGroups: known, StrictGroups: true}, v)
+	assert.Equal(t, UnknownGroupError{Group: "pubilc"}, err)
+
+	var buf bytes.Buffer
+	err = NewEncoder(&buf, &Options{Groups: []string{"admni"}, KnownGroups: known, StrictGroups: true}).Encode(v)
+	assert.Equal(t, UnknownGroupError{Group: "admni"}, err)
+}
+
+type TestGroupOverridesChild struct {
+	Value string `json:"value"`
+}
+
+type TestGroupOverridesModel struct {
+	Username string                  `json:"username" groups:"api"`
+	SSN      string                  `json:"ssn" groups:"admin"`
+	Email    string                  `json:"email" groups:"api"`
+	NoGroup  string                  `json:"no_group"`
+	Child    TestGroupOverridesChild `json:"child"`
+}
+
+func TestMarshal_FieldGroupOverrides(t *testing.T) {
+	v := TestGroupOverridesModel{Username: "user", SSN: "ssn", Email: "email", NoGroup: "no_group", Child: TestGroupOverridesChild{Value: "value"}}
+	overrides := map[string][]string{
+		"TestGroupOverridesModel.SSN":     {"beta"},
+		"TestGroupOverridesModel.Email":   {"!beta"},
+		"TestGroupOverridesModel.Child":   {"beta"},
+		"TestGroupOverridesChild.Value":   {"beta"},
+		"TestGroupOverridesModel.Missing": {"beta"},
+		"OtherModel.Username":             {"beta"},
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"beta"}}, `{}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"beta"}, FieldGroupOverrides: overrides}, `{"ssn":"ssn","child":{"value":"value"}}`)
+	// the groups of the tag still apply
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"admin"}, FieldGroupOverrides: overrides}, `{"ssn":"ssn"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}, FieldGroupOverrides: overrides}, `{"username":"user","email":"email"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api", "beta"}, FieldGroupOverrides: overrides}, `{"username":"user","ssn":"ssn","child":{"value":"value"}}`)
+
+	// overrides which don't match any field have no effect
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}, FieldGroupOverrides: map[string][]string{"TestGroupOverridesModel.Missing": {"api"}}}, `{"username":"user","email":"email"}`)
+
+	exposure, err := FieldExposure(reflect.TypeOf(v), &Options{Groups: []string{"beta"}, FieldGroupOverrides: overrides})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"ssn": {"beta"}, "child": {"beta"}}, exposure)
+}
+
+type TestFlattenModel struct {
+	Nil    []string    `json:"nil"`
+	Empty  []string    `json:"empty"`
+	One    []string    `json:"one"`
+	Two    []string    `json:"two"`
+	Array  [1]int      `json:"array"`
+	Nested [][]AModel  `json:"nested"`
+	Any    interface{} `json:"any"`
+}
+
+func TestMarshal_FlattenSingleElementSlices(t *testing.T) {
+	v := TestFlattenModel{
+		Empty:  []string{},
+		One:    []string{"one"},
+		Two:    []string{"one", "two"},
+		Array:  [1]int{1},
+		Nested: [][]AModel{{{AllGroups: true}}},
+		Any:    []interface{}{[]string{"any"}},
+	}
+
+	verifyOutputGivenOptions(t, v, &Options{}, `{"nil":null,"empty":[],"one":["one"],"two":["one","two"],"array":[1],"nested":[[{"something":true,"something_else":false}]],"any":[["any"]]}`)
+	expected := `{"nil":null,"empty":[],"one":"one","two":["one","two"],"array":1,"nested":{"something":true,"something_else":false},"any":"any"}`
+	verifyOutputGivenOptions(t, v, &Options{FlattenSingleElementSlices: true}, expected)
+
+	var buf bytes.Buffer
+	assert.NoError(t, NewEncoder(&buf, &Options{FlattenSingleElementSlices: true}).Encode(v))
+	assert.JSONEq(t, expected, buf.String())
+
+	// the passed slice is never flattened
+	verifyOutputGivenOptions(t, []TestFlattenModel{{One: []string{"one"}}}, &Options{FlattenSingleElementSlices: true},
+		`[{"nil":null,"empty":null,"one":"one","two":null,"array":0,"nested":null,"any":null}]`)
+	buf.Reset()
+	assert.NoError(t, NewEncoder(&buf, &Options{FlattenSingleElementSlices: true}).Encode([]string{"one"}))
+	assert.JSONEq(t, `["one"]`, buf.String())
+}
+
+type TestStringerStruct struct {
+	Public string `json:"public" groups:"api"`
+	Secret string `json:"secret" groups:"admin"`
+}
+
+func (s TestStringerStruct) String() string {
+	return s.Public
+}
+
+type TestStringerModel struct {
+	TestStringerStruct
+	Field   TestStringerStruct  `json:"field" groups:"api"`
+	Pointer *TestStringerStruct `json:"pointer" groups:"api"`
+}
+
+func TestMarshal_IgnoreStringer(t *testing.T) {
+	s := TestStringerStruct{Public: "public", Secret: "secret"}
+	v := TestStringerModel{TestStringerStruct: s, Field: s, Pointer: &s}
+
+	// by default, stringers are passed to encoding/json as is
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}},
+		`{"TestStringerStruct":{"public":"public","secret":"secret"},"field":{"public":"public","secret":"secret"},"pointer":{"public":"public","secret":"secret"}}`)
+
+	expected := `{"public":"public","field":{"public":"public"},"pointer":{"public":"public"}}`
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}, IgnoreStringer: true}, expected)
+	verifyOutputGivenOptions(t, []TestStringerStruct{s}, &Options{Groups: []string{"api"}, IgnoreStringer: true}, `[{"public":"public"}]`)
+
+	var buf bytes.Buffer
+	assert.NoError(t, NewEncoder(&buf, &Options{Groups: []string{"api"}, IgnoreStringer: true}).Encode(v))
+	assert.JSONEq(t, expected, buf.String())
+
+	// types implementing encoding.TextMarshaler are left to it regardless
+	verifyOutputGivenOptions(t, map[string]interface{}{"ip": net.ParseIP("127.0.0.1")}, &Options{IgnoreStringer: true}, `{"ip":"127.0.0.1"}`)
+}
+
+type PathRecordingValue struct {
+	paths *[]string
+}
+
+func (p PathRecordingValue) MarshalSheriff(mc MarshallerContext) (interface{}, error) {
+	*p.paths = append(*p.paths, mc.Path)
+	return mc.Path, nil
+}
+
+type TestMarshallerPathChild struct {
+	Value PathRecordingValue `json:"value"`
+}
+
+type TestMarshallerPathModel struct {
+	TestMarshallerPathChild
+	Items  []TestMarshallerPathChild          `json:"items"`
+	ByKey  map[string]TestMarshallerPathChild `json:"by_key"`
+	Direct PathRecordingValue                 `json:"direct"`
+}
+
+func TestMarshal_ContextMarshallerPath(t *testing.T) {
+	var paths []string
+	r := PathRecordingValue{&paths}
+	v := TestMarshallerPathModel{
+		TestMarshallerPathChild: TestMarshallerPathChild{Value: r},
+		Items:                   []TestMarshallerPathChild{{Value: r}, {Value: r}},
+		ByKey:                   map[string]TestMarshallerPathChild{"key": {Value: r}},
+		Direct:                  r,
+	}
+	expected := `{"value":".TestMarshallerPathChild.Value","items":[{"value":".Items[0].Value"},{"value":".Items[1].Value"}],"by_key":{"key":{"value":".ByKey[key].Value"}},"direct":".Direct"}`
+
+	verifyOutputGivenOptions(t, v, &Options{}, expected)
+	var buf bytes.Buffer
+	assert.NoError(t, NewEncoder(&buf, &Options{}).Encode(v))
+	assert.JSONEq(t, expected, buf.String())
+
+	paths = nil
+	verifyOutputGivenOptions(t, []interface{}{r, []PathRecordingValue{r}}, &Options{}, `["[0]",["[1][0]"]]`)
+	assert.Equal(t, []string{"[0]", "[1][0]"}, paths)
+}
+
+type TestGroupsIncludeModel struct {
+	Username string `json:"username" groups:"api"`
+	SSN      string `json:"-" groups_include:"audit"`
+	Token    string `json:"-" groups:"api" groups_include:"audit,admin"`
+	Secret   string `json:"-"`
+}
+
+func TestMarshal_GroupsInclude(t *testing.T) {
+	v := TestGroupsIncludeModel{Username: "user", SSN: "ssn", Token: "token", Secret: "secret"}
+
+	// hidden by default
+	verifyOutputGivenOptions(t, v, &Options{}, `{"username":"user"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}}, `{"username":"user"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"*"}}, `{"username":"user"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api"}, OutputFieldsWithNoGroup: true}, `{"username":"user"}`)
+
+	// exposed to the included groups
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"audit"}}, `{"SSN":"ssn","Token":"token"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"api", "admin"}}, `{"username":"user","Token":"token"}`)
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"audit", "-admin"}}, `{"SSN":"ssn"}`)
+
+	exposure, err := FieldExposure(reflect.TypeOf(v), &Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"username": {"api"}, "SSN": {"audit"}, "Token": {"admin", "audit"}}, exposure)
+}
+
+type TestHiddenUnsupportedModel struct {
+	Name    string   `json:"name" groups:"public"`
+	Channel chan int `json:"channel" groups:"admin"`
+}
+
+func TestMarshal_HiddenUnsupported(t *testing.T) {
+	v := TestHiddenUnsupportedModel{Name: "name", Channel: make(chan int)}
+
+	// hidden fields aren't marshalled, so their types don't matter
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"public"}}, `{"name":"name"}`)
+
+	verifyOutputGivenOptions(t, v, &Options{Groups: []string{"public"}, RejectUnsupported: true}, `{"name":"name"}`)
+
+	_, err := Marshal(&Options{Groups: []string{"admin"}, RejectUnsupported: true}, v)
+	assert.EqualError(t, err, "marshaller: Unable to marshal unsupported type chan. Path: TestHiddenUnsupportedModel.Channel")
+	_, err = Marshal(&Options{RejectUnsupported: true}, make(chan int))
+	assert.EqualError(t, err, "marshaller: Unable to marshal unsupported type chan.")
+}
+
+type FailingMarshaller struct{}
+
+func (FailingMarshaller) Marshal(options *Options) (interface{}, error) {
+	return nil, errors.New("boom")
+}
+
+type FieldFilterHiddenChild struct {
+	Name    string            `json:"name" groups:"api"`
+	Failing FailingMarshaller `json:"failing" groups:"api"`
+}
+
+type TestFieldFilterHiddenModel struct {
+	Name  string                 `json:"name" groups:"api"`
+	Child FieldFilterHiddenChild `json:"child" groups:"admin"`
+}
+
+func TestMarshal_FieldFilterOnlyShownFields(t *testing.T) {
+	v := TestFieldFilterHiddenModel{Name: "name", Child: FieldFilterHiddenChild{Name: "child"}}
+
+	var called []string
+	options := &Options{Groups: []string{"api"}, FieldFilter: func(field FieldInfo) bool {
+		called = append(called, field.Parent.Type().Name()+"."+field.Field.Name)
+		return true
+	}}
+	verifyOutputGivenOptions(t, v, options, `{"name":"name"}`)
+	assert.Equal(t, []string{"TestFieldFilterHiddenModel.Name"}, called)
+
+	// the value of a filtered field isn't marshalled
+	_, err := Marshal(&Options{Groups: []string{"api"}}, v.Child)
+	assert.EqualError(t, err, "boom")
+	withoutFailing := func(field FieldInfo) bool { return field.Name != "failing" }
+	verifyOutputGivenOptions(t, v.Child, &Options{Groups: []string{"api"}, FieldFilter: withoutFailing}, `{"name":"child"}`)
+}
@@ -0,0 +1,101 @@
+package sheriff
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// StreamMarshaller writes the JSON encoding of marshalled data to an io.Writer.
+//
+// Top-level slices and arrays are written element by element, so the marshalled
+// result of the whole slice never has to be held in memory at once.
+type StreamMarshaller struct {
+	w       io.Writer
+	options *Options
+}
+
+// NewStreamMarshaller returns a StreamMarshaller writing to w using the given options.
+func NewStreamMarshaller(w io.Writer, options *Options) *StreamMarshaller {
+	return &StreamMarshaller{w: w, options: options}
+}
+
+// MarshalStream writes the JSON encoding of data to the underlying writer.
+//
+// The output is identical to passing the result of Marshal to json.Marshal.
+func (s *StreamMarshaller) MarshalStream(data interface{}) error {
+	v := reflect.ValueOf(data)
+	if v.Kind() == reflect.Ptr {
+		// follow pointer
+		v = v.Elem()
+	}
+
+	if !isStreamable(s.options, v) {
+		return s.marshalBuffered(data)
+	}
+
+	options, err := resolveOptions(s.options)
+	if err != nil {
+		return err
+	}
+	if err := checkRequireStruct(options, data); err != nil {
+		return err
+	}
+	groups := make(groupSet)
+	groups.incrementGroups(options.Groups)
+	parents := make(groupSet)
+	visited := make(pointerSet)
+	path := &fieldPath{}
+
+	if _, err := io.WriteString(s.w, "["); err != nil {
+		return err
+	}
+	for i := 0; i < v.Len(); i++ {
+		if i > 0 {
+			if _, err := io.WriteString(s.w, ","); err != nil {
+				return err
+			}
+		}
+		path.pushIndex(i)
+		d, err := marshalValue(context.Background(), options, v.Index(i), groups, parents, visited, path, 1, false)
+		path.pop()
+		if err != nil {
+			return prefixErrorPath(err, "["+strconv.Itoa(i)+"]")
+		}
+		b, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		if _, err := s.w.Write(b); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(s.w, "]")
+	return err
+}
+
+func (s *StreamMarshaller) marshalBuffered(data interface{}) error {
+	b, err := MarshalJSON(s.options, data)
+	if err != nil {
+		return err
+	}
+	_, err = s.w.Write(b)
+	return err
+}
+
+// isStreamable checks whether v is a slice or array which is marshalled element by element.
+func isStreamable(options *Options, v reflect.Value) bool {
+	if !v.IsValid() || !v.CanInterface() {
+		return false
+	}
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return false
+	}
+	if v.Kind() == reflect.Slice && v.IsNil() {
+		return false
+	}
+	val := v.Interface()
+	return !marshalledBySelf(val) && !marshalledByJSON(options, val)
+}
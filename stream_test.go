@@ -0,0 +1,69 @@
+package sheriff
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func assertStreamEqualsBuffered(t *testing.T, options *Options, data interface{}) {
+	expected, err := MarshalJSON(options, data)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, NewStreamMarshaller(&buf, options).MarshalStream(data))
+	assert.Equal(t, string(expected), buf.String())
+}
+
+func TestStreamMarshaller_MarshalStream(t *testing.T) {
+	models := []*TestGroupsModel{
+		{
+			DefaultMarshal:     "DefaultMarshal",
+			OnlyGroupTest:      "OnlyGroupTest",
+			OnlyGroupTestOther: "OnlyGroupTestOther",
+			SliceString:        []string{"test", "bla"},
+			MapStringStruct:    map[string]AModel{"firstModel": {true, true}},
+		},
+		{
+			GroupTestAndOther: "GroupTestAndOther",
+			OmitEmpty:         "OmitEmpty",
+		},
+	}
+	o := &Options{Groups: []string{"test"}}
+
+	assertStreamEqualsBuffered(t, o, models)
+	assertStreamEqualsBuffered(t, o, &models)
+	assertStreamEqualsBuffered(t, o, [2]*TestGroupsModel{models[0], models[1]})
+	assertStreamEqualsBuffered(t, o, []*TestGroupsModel{})
+	assertStreamEqualsBuffered(t, o, []*TestGroupsModel(nil))
+	assertStreamEqualsBuffered(t, o, []byte("bytes"))
+	assertStreamEqualsBuffered(t, o, models[0])
+}
+
+func TestStreamMarshaller_MarshalStreamRequireStruct(t *testing.T) {
+	o := &Options{RequireStruct: true}
+
+	var buf bytes.Buffer
+	err := NewStreamMarshaller(&buf, o).MarshalStream([]string{"not", "structs"})
+	assert.IsType(t, MarshalInvalidTypeError{}, err)
+	err = NewStreamMarshaller(&buf, o).MarshalStream(map[string]string{"key": "value"})
+	assert.IsType(t, MarshalInvalidTypeError{}, err)
+	assert.Empty(t, buf.String())
+
+	assertStreamEqualsBuffered(t, o, []*TestGroupsModel{{}})
+}
+
+func TestStreamMarshaller_MarshalStreamErrorPath(t *testing.T) {
+	o := &Options{RejectUnsupported: true}
+	data := []interface{}{TestGroupsModel{}, TestHiddenUnsupportedModel{}}
+
+	var buf bytes.Buffer
+	err := NewStreamMarshaller(&buf, o).MarshalStream(data)
+	assert.IsType(t, MarshalInvalidTypeError{}, err)
+	assert.Equal(t, "[1].Channel", err.(MarshalInvalidTypeError).Path)
+
+	// the path is the same as with Marshal
+	_, expected := Marshal(o, data)
+	assert.Equal(t, expected, err)
+}
@@ -0,0 +1,23 @@
+package sheriff
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTag(t *testing.T) {
+	name, opts := ParseTag("field,omitempty,string")
+	assert.Equal(t, "field", name)
+	assert.True(t, opts.Contains("omitempty"))
+	assert.True(t, opts.Contains("string"))
+	assert.False(t, opts.Contains("omit"))
+
+	name, opts = ParseTag(",omitempty")
+	assert.Equal(t, "", name)
+	assert.True(t, opts.Contains("omitempty"))
+
+	name, opts = ParseTag("-")
+	assert.Equal(t, "-", name)
+	assert.False(t, opts.Contains("omitempty"))
+}
@@ -0,0 +1,331 @@
+package sheriff
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	version "github.com/hashicorp/go-version"
+)
+
+// fieldInfo contains the parsed tags of a struct field.
+type fieldInfo struct {
+	// name is the key used in the output map
+	name string
+	// jsonOpts contains the options of the field tag, e.g. the json tag
+	jsonOpts TagOptions
+	// skip is set if the field is never marshalled, e.g. `json:"-"`
+	skip bool
+	// anonymous is set if the field is an embedded field or an inline field, e.g. `json:",inline"`
+	anonymous bool
+	// aliases maps groups to the key used instead of name, e.g. `alias:"public=user_id"`
+	aliases map[string]string
+	// timeFormat is the layout used to format a time.Time value, e.g. `timeformat:"2006-01-02"`
+	timeFormat string
+	// transform is the key of the function in Options.FieldTransformers applied to the value
+	transform string
+	// quoted is set if the value is encoded as a JSON string, e.g. `json:",string"`
+	quoted bool
+	// tagged is set if the field has any tag evaluated by sheriff besides the field tag
+	tagged bool
+	// shadowedNames contains the names provided by the field which are hidden by other fields like
+	// encoding/json does. For embedded structs, these are names of its fields.
+	shadowedNames map[string]bool
+
+	// groupNames and negatedGroupNames are the groups of the group tag
+	groupNames        []string
+	negatedGroupNames []string
+	// additiveGroupNames are the groups of the group tag prefixed with `+`, which are part of groupNames as well
+	additiveGroupNames []string
+	// excludedGroupNames are the groups of the exclude_groups tag
+	excludedGroupNames []string
+	// omitEmptyGroupNames are the groups of the groups_omitempty tag, which are part of groupNames as well
+	omitEmptyGroupNames []string
+	// includeGroupNames are the groups of the groups_include tag of a skipped field, which are part of groupNames
+	// as well. Requesting one of them outputs the field using its Go name despite `json:"-"`.
+	includeGroupNames []string
+
+	// sinceVersion and untilVersion are the parsed since and until tags.
+	// Errors are kept to be returned when the versions are actually used.
+	sinceVersion *version.Version
+	sinceErr     error
+	untilVersion *version.Version
+	untilErr     error
+
+	// betweenVersions contains the inclusive bounds of the between tag, e.g. `between:"2.0.0,3.5.0"`.
+	betweenVersions [2]*version.Version
+	betweenErr      error
+
+	// versionConstraints contains the alternatives of the version tag separated by `||`.
+	versionConstraints []version.Constraints
+	// groupVersionConstraints contains the alternatives of the version tag entries scoped to a group,
+	// e.g. `version:"public:>=2.0.0;internal:>=1.0.0"`.
+	groupVersionConstraints map[string][]version.Constraints
+	versionErr              error
+}
+
+// typeCacheKey identifies the parsed fields of a struct type for the tag names set in the options.
+type typeCacheKey struct {
+	t        reflect.Type
+	fieldTag string
+	groupTag string
+	groupSep string
+	sinceTag string
+	untilTag string
+	// ignoreStringer is Options.IgnoreStringer, which determines whether embedded fmt.Stringer structs are promoted
+	ignoreStringer bool
+}
+
+// typeCache maps a typeCacheKey to its []fieldInfo.
+var typeCache = struct {
+	sync.RWMutex
+	m map[typeCacheKey][]fieldInfo
+}{m: make(map[typeCacheKey][]fieldInfo)}
+
+// cachedFields returns the parsed fields of the struct type t, indexed like t.Field(i).
+func cachedFields(options *Options, t reflect.Type) []fieldInfo {
+	key := typeCacheKey{
+		t:              t,
+		fieldTag:       defaultString(options.FieldTag, "json"),
+		groupTag:       defaultString(options.GroupTagName, "groups"),
+		groupSep:       defaultString(options.GroupSeparator, ","),
+		sinceTag:       defaultString(options.SinceTagName, "since"),
+		untilTag:       defaultString(options.UntilTagName, "until"),
+		ignoreStringer: options.IgnoreStringer,
+	}
+	typeCache.RLock()
+	fields, ok := typeCache.m[key]
+	typeCache.RUnlock()
+	if ok {
+		return fields
+	}
+
+	fields = parseFields(key)
+	typeCache.Lock()
+	typeCache.m[key] = fields
+	typeCache.Unlock()
+	return fields
+}
+
+func parseFields(key typeCacheKey) []fieldInfo {
+	t := key.t
+	_, shadowed := resolveNames(key, make(map[reflect.Type]bool))
+	fields := make([]fieldInfo, t.NumField())
+	for i := range fields {
+		field := t.Field(i)
+		info := &fields[i]
+		info.shadowedNames = shadowed[i]
+
+		jsonTag, jsonOpts := ParseTag(field.Tag.Get(key.fieldTag))
+
+		// If no json tag is provided, use the field Name
+		if jsonTag == "" {
+			jsonTag = field.Name
+		}
+		info.name = jsonTag
+		info.jsonOpts = jsonOpts
+		info.skip = jsonTag == "-"
+		info.anonymous = isInlineField(field, key.fieldTag)
+		info.quoted = jsonOpts.Contains("string") && isQuotable(field.Type)
+
+		if groups := field.Tag.Get(key.groupTag); groups != "" {
+			info.groupNames, info.negatedGroupNames = splitNegatedGroups(splitGroups(groups, key.groupSep))
+			info.groupNames, info.additiveGroupNames = splitAdditiveGroups(info.groupNames)
+		}
+		if groups := field.Tag.Get(key.groupTag + "_omitempty"); groups != "" {
+			info.omitEmptyGroupNames = splitGroups(groups, key.groupSep)
+			info.groupNames = append(info.groupNames, info.omitEmptyGroupNames...)
+		}
+		if groups := field.Tag.Get(key.groupTag + "_include"); groups != "" && info.skip {
+			info.name = field.Name
+			info.includeGroupNames = splitGroups(groups, key.groupSep)
+			info.groupNames = append(info.groupNames, info.includeGroupNames...)
+		}
+		info.timeFormat = field.Tag.Get("timeformat")
+		info.transform = field.Tag.Get("transform")
+		if alias := field.Tag.Get("alias"); alias != "" {
+			info.aliases = parseAliases(alias, key.groupSep)
+		}
+		if excludeGroups := field.Tag.Get("exclude_groups"); excludeGroups != "" {
+			info.excludedGroupNames = splitGroups(excludeGroups, key.groupSep)
+		}
+		if since := field.Tag.Get(key.sinceTag); since != "" {
+			info.sinceVersion, info.sinceErr = version.NewVersion(since)
+			info.sinceErr = versionTagError(t, field, key.sinceTag, info.sinceErr)
+		}
+		if until := field.Tag.Get(key.untilTag); until != "" {
+			info.untilVersion, info.untilErr = version.NewVersion(until)
+			info.untilErr = versionTagError(t, field, key.untilTag, info.untilErr)
+		}
+		if between := field.Tag.Get("between"); between != "" {
+			info.betweenVersions, info.betweenErr = parseVersionRange(between)
+		}
+		if v := field.Tag.Get("version"); v != "" {
+			info.groupVersionConstraints, info.versionConstraints, info.versionErr = parseGroupVersionConstraints(v)
+			info.versionErr = versionTagError(t, field, "version", info.versionErr)
+		}
+		info.tagged = hasSheriffTags(field, key)
+	}
+	return fields
+}
+
+// sheriffTags are the tags evaluated by sheriff besides the field, group, since and until tags set in the options.
+var sheriffTags = []string{"timeformat", "transform", "alias", "exclude_groups", "between", "version"}
+
+// hasSheriffTags checks whether field has any of the tags evaluated by sheriff besides the field tag.
+func hasSheriffTags(field reflect.StructField, key typeCacheKey) bool {
+	for _, tag := range append([]string{key.groupTag, key.groupTag + "_omitempty", key.groupTag + "_include", key.sinceTag, key.untilTag}, sheriffTags...) {
+		if _, ok := field.Tag.Lookup(tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// HasSheriffTags checks whether the struct type t, or a pointer to it, has any fields with tags evaluated by sheriff
+// using the default tag names, including the fields of embedded structs. The fields of a struct type without such
+// tags are marshalled faster, but as they are only subject to the options, such types might as well be passed to
+// json.Marshal directly.
+func HasSheriffTags(t reflect.Type) bool {
+	return hasTaggedFields(&Options{}, t, make(map[reflect.Type]bool))
+}
+
+func hasTaggedFields(options *Options, t reflect.Type, visiting map[reflect.Type]bool) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || visiting[t] {
+		return false
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	fields := cachedFields(options, t)
+	for i := range fields {
+		if fields[i].tagged {
+			return true
+		}
+		if embedded := embeddedStructType(t.Field(i), defaultString(options.FieldTag, "json"), options.IgnoreStringer); embedded != nil &&
+			hasTaggedFields(options, embedded, visiting) {
+			return true
+		}
+	}
+	return false
+}
+
+// versionTagError wraps an error parsing the version tag of the field of the struct type t with its context.
+func versionTagError(t reflect.Type, field reflect.StructField, tag string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return InvalidVersionTagError{Field: t.Name() + "." + field.Name, Tag: tag, Err: err}
+}
+
+// parseGroupVersionConstraints parses the entries of a version tag separated by `;`. Entries prefixed with a group
+// and `:`, e.g. "public:>=2.0.0", are returned per group, while the alternatives of the other entries are combined.
+func parseGroupVersionConstraints(s string) (map[string][]version.Constraints, []version.Constraints, error) {
+	var groupConstraints map[string][]version.Constraints
+	var constraints []version.Constraints
+	for _, entry := range strings.Split(s, ";") {
+		var group string
+		if i := strings.Index(entry, ":"); i >= 0 {
+			group, entry = strings.TrimSpace(entry[:i]), entry[i+1:]
+		}
+		c, err := parseVersionConstraints(entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		if group == "" {
+			constraints = append(constraints, c...)
+			continue
+		}
+		if groupConstraints == nil {
+			groupConstraints = make(map[string][]version.Constraints)
+		}
+		groupConstraints[group] = append(groupConstraints[group], c...)
+	}
+	return groupConstraints, constraints, nil
+}
+
+// parseVersionConstraints parses alternatives of go-version constraints separated by `||`,
+// e.g. ">=2.0.0,<3.0.0 || >=3.4.0".
+func parseVersionConstraints(s string) ([]version.Constraints, error) {
+	var constraints []version.Constraints
+	for _, alternative := range strings.Split(s, "||") {
+		c, err := version.NewConstraint(strings.TrimSpace(alternative))
+		if err != nil {
+			return nil, err
+		}
+		constraints = append(constraints, c)
+	}
+	return constraints, nil
+}
+
+// parseVersionRange parses the two comma-separated versions of a between tag, e.g. "2.0.0,3.5.0".
+func parseVersionRange(s string) ([2]*version.Version, error) {
+	var versions [2]*version.Version
+	bounds := strings.Split(s, ",")
+	if len(bounds) != 2 {
+		return versions, InvalidVersionRangeError{Value: s}
+	}
+	for i, bound := range bounds {
+		v, err := version.NewVersion(strings.TrimSpace(bound))
+		if err != nil {
+			return [2]*version.Version{}, err
+		}
+		versions[i] = v
+	}
+	return versions, nil
+}
+
+// defaultString returns s or def if s is empty.
+func defaultString(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// isQuotable checks whether the `string` option applies to a field of type t.
+// Like encoding/json, it applies to strings, floats, integers and booleans
+// as well as unnamed pointers to those, unless they marshal themselves.
+func isQuotable(t reflect.Type) bool {
+	if t.Name() == "" && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType) {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.String:
+		return true
+	}
+	return false
+}
+
+var (
+	marshallerType        = reflect.TypeOf((*Marshaller)(nil)).Elem()
+	contextMarshallerType = reflect.TypeOf((*ContextMarshaller)(nil)).Elem()
+	jsonMarshalerType     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType     = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	stringerType          = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+)
+
+// parseAliases parses group=name pairs separated by sep. Entries without a `=` are ignored.
+func parseAliases(s, sep string) map[string]string {
+	aliases := make(map[string]string)
+	for _, alias := range splitGroups(s, sep) {
+		if idx := strings.Index(alias, "="); idx != -1 {
+			aliases[alias[:idx]] = alias[idx+1:]
+		}
+	}
+	return aliases
+}
@@ -0,0 +1,223 @@
+package sheriff
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// UnmarshalInvalidTypeError is an error returned to indicate the wrong type has been
+// passed as destination to Unmarshal.
+type UnmarshalInvalidTypeError struct {
+	// t reflects the type of the destination
+	t reflect.Type
+}
+
+func (e UnmarshalInvalidTypeError) Error() string {
+	return fmt.Sprintf("unmarshaller: Unable to unmarshal into type %s. Non-nil pointer to struct required.", e.t)
+}
+
+// UnmarshalExcludedFieldError is an error returned to indicate the passed data contains
+// a key which maps to a field being excluded by the options.
+type UnmarshalExcludedFieldError struct {
+	// Key is the key in the passed data
+	Key string
+}
+
+func (e UnmarshalExcludedFieldError) Error() string {
+	return fmt.Sprintf("unmarshaller: Key %q refers to a field which is not allowed with the given options.", e.Key)
+}
+
+// Unmarshal is the inverse of Marshal. It assigns the values in `data` to the fields of
+// `dest` which would have been marshalled with the given options.
+//
+// The argument `dest` has to be a non-nil pointer to a struct. Fields which are excluded
+// by the options keep their zero value. If `data` contains a key referring to an excluded
+// field, an UnmarshalExcludedFieldError is returned.
+func Unmarshal(options *Options, data map[string]interface{}, dest interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return UnmarshalInvalidTypeError{t: reflect.TypeOf(dest)}
+	}
+
+	options, err := resolveOptions(options)
+	if err != nil {
+		return err
+	}
+	groups := make(groupSet)
+	groups.incrementGroups(options.Groups)
+	parents := make(groupSet)
+	return unmarshalObject(options, data, v.Elem(), groups, parents, false)
+}
+
+// UnmarshalJSON decodes the JSON object in `data` and assigns it to `dest` using Unmarshal.
+func UnmarshalJSON(options *Options, data []byte, dest interface{}) error {
+	var m map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	// keep numbers as they are to avoid losing precision of large integers
+	d.UseNumber()
+	if err := d.Decode(&m); err != nil {
+		return err
+	}
+	return Unmarshal(options, m, dest)
+}
+
+func unmarshalObject(options *Options, data map[string]interface{}, v reflect.Value, groups, parents groupSet, embeddedParents bool) error {
+	t := v.Type()
+	fields := cachedFields(options, t)
+
+	for i := range fields {
+		field := withGroupOverrides(options, &fields[i], t, i)
+		val := v.Field(i)
+
+		if field.skip && !groups.containsAny(field.includeGroupNames) {
+			continue
+		}
+		// skip unexported fields
+		if !val.CanSet() {
+			continue
+		}
+
+		fieldType := val.Type()
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		isEmbeddedField := field.anonymous && fieldType.Kind() == reflect.Struct
+		shouldShow, parentGroups, err := shouldMarshalField(options, field, isEmbeddedField, groups, parents, embeddedParents)
+		if err != nil {
+			return err
+		}
+
+		if isEmbeddedField {
+			if !shouldShow {
+				continue
+			}
+			if val.Kind() == reflect.Ptr {
+				if val.IsNil() {
+					val.Set(reflect.New(fieldType))
+				}
+				val = val.Elem()
+			}
+			embeddedData := data
+			if len(field.shadowedNames) > 0 {
+				embeddedData = make(map[string]interface{}, len(data))
+				for k, v := range data {
+					if !isShadowed(options, field, k) {
+						embeddedData[k] = v
+					}
+				}
+			}
+			childParents := enterField(options, parents, parentGroups, true)
+			err = unmarshalObject(options, embeddedData, val, groups, childParents, true)
+			leaveField(options, parents, parentGroups, true)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if field.shadowedNames[field.name] {
+			continue
+		}
+		name := fieldName(options, field)
+		src, ok := data[name]
+		if !ok {
+			continue
+		}
+		if !shouldShow {
+			return UnmarshalExcludedFieldError{Key: name}
+		}
+
+		childParents := enterField(options, parents, parentGroups, false)
+		if s, ok := src.(string); ok && field.quoted {
+			// the value has been encoded as a JSON string, e.g. `json:",string"`
+			err = json.Unmarshal([]byte(s), val.Addr().Interface())
+		} else {
+			err = unmarshalValue(options, src, val, groups, childParents)
+		}
+		leaveField(options, parents, parentGroups, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unmarshalValue assigns `src` to the settable value `v`.
+//
+// Structs, slices, arrays and maps with string keys are walked recursively in order to apply the options
+// to nested structs. All other values are assigned using encoding/json.
+func unmarshalValue(options *Options, src interface{}, v reflect.Value, groups, parents groupSet) error {
+	if src == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	// types which implement one of the following interfaces handle the decoding themselves.
+	switch v.Addr().Interface().(type) {
+	case json.Unmarshaler, encoding.TextUnmarshaler:
+		return unmarshalJSON(src, v)
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		elem := reflect.New(v.Type().Elem())
+		if err := unmarshalValue(options, src, elem.Elem(), groups, parents); err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+	case reflect.Struct:
+		if m, ok := src.(map[string]interface{}); ok {
+			return unmarshalObject(options, m, v, groups, parents, false)
+		}
+	case reflect.Slice:
+		if l, ok := src.([]interface{}); ok {
+			dest := reflect.MakeSlice(v.Type(), len(l), len(l))
+			for i := range l {
+				if err := unmarshalValue(options, l[i], dest.Index(i), groups, parents); err != nil {
+					return err
+				}
+			}
+			v.Set(dest)
+			return nil
+		}
+	case reflect.Array:
+		if l, ok := src.([]interface{}); ok {
+			dest := reflect.New(v.Type()).Elem()
+			for i := 0; i < len(l) && i < dest.Len(); i++ {
+				if err := unmarshalValue(options, l[i], dest.Index(i), groups, parents); err != nil {
+					return err
+				}
+			}
+			v.Set(dest)
+			return nil
+		}
+	case reflect.Map:
+		if m, ok := src.(map[string]interface{}); ok && v.Type().Key().Kind() == reflect.String {
+			dest := reflect.MakeMap(v.Type())
+			for key, value := range m {
+				elem := reflect.New(v.Type().Elem()).Elem()
+				if err := unmarshalValue(options, value, elem, groups, parents); err != nil {
+					return err
+				}
+				dest.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+			}
+			v.Set(dest)
+			return nil
+		}
+	}
+	return unmarshalJSON(src, v)
+}
+
+// unmarshalJSON assigns `src` to `v` by encoding and decoding it using encoding/json.
+func unmarshalJSON(src interface{}, v reflect.Value) error {
+	b, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v.Addr().Interface())
+}
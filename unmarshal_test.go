@@ -0,0 +1,171 @@
+package sheriff
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	version "github.com/hashicorp/go-version"
+	"github.com/stretchr/testify/assert"
+)
+
+type UnmarshalChild struct {
+	Public  string `json:"public" groups:"api"`
+	Private string `json:"private" groups:"admin"`
+}
+
+type UnmarshalEmbedded struct {
+	Embedded string `json:"embedded" groups:"api"`
+}
+
+type TestUnmarshalModel struct {
+	UnmarshalEmbedded
+	Name      string                    `json:"name" groups:"api"`
+	Secret    string                    `json:"secret" groups:"admin"`
+	Since2    string                    `json:"since_2" groups:"api" since:"2"`
+	Child     UnmarshalChild            `json:"child" groups:"api"`
+	ChildPtr  *UnmarshalChild           `json:"child_ptr" groups:"api"`
+	Children  []UnmarshalChild          `json:"children" groups:"api"`
+	ChildMap  map[string]UnmarshalChild `json:"child_map" groups:"api"`
+	Numbers   []int                     `json:"numbers" groups:"api"`
+	CreatedAt time.Time                 `json:"created_at" groups:"api"`
+	Ignored   string                    `json:"-"`
+}
+
+func TestUnmarshal_RoundTrip(t *testing.T) {
+	createdAt, err := time.Parse(time.RFC3339, "2017-01-20T18:11:00Z")
+	assert.NoError(t, err)
+
+	v1, err := version.NewVersion("1.0.0")
+	assert.NoError(t, err)
+
+	model := TestUnmarshalModel{
+		UnmarshalEmbedded: UnmarshalEmbedded{"embedded"},
+		Name:              "name",
+		Secret:            "secret",
+		Since2:            "since_2",
+		Child:             UnmarshalChild{"public", "private"},
+		ChildPtr:          &UnmarshalChild{"public_ptr", "private_ptr"},
+		Children:          []UnmarshalChild{{"public_0", "private_0"}},
+		ChildMap:          map[string]UnmarshalChild{"a": {"public_a", "private_a"}},
+		Numbers:           []int{1, 2},
+		CreatedAt:         createdAt,
+		Ignored:           "ignored",
+	}
+	o := &Options{Groups: []string{"api"}, ApiVersion: v1}
+
+	// run through encoding/json to get the data as it would be received by an API
+	marshalled, err := Marshal(o, model)
+	assert.NoError(t, err)
+	b, err := json.Marshal(marshalled)
+	assert.NoError(t, err)
+	var data map[string]interface{}
+	assert.NoError(t, json.Unmarshal(b, &data))
+
+	var actual TestUnmarshalModel
+	assert.NoError(t, Unmarshal(o, data, &actual))
+
+	expected := TestUnmarshalModel{
+		UnmarshalEmbedded: UnmarshalEmbedded{"embedded"},
+		Name:              "name",
+		Child:             UnmarshalChild{Public: "public"},
+		ChildPtr:          &UnmarshalChild{Public: "public_ptr"},
+		Children:          []UnmarshalChild{{Public: "public_0"}},
+		ChildMap:          map[string]UnmarshalChild{"a": {Public: "public_a"}},
+		Numbers:           []int{1, 2},
+		CreatedAt:         createdAt,
+	}
+	assert.Equal(t, expected, actual)
+}
+
+func TestUnmarshal_ExcludedField(t *testing.T) {
+	o := &Options{Groups: []string{"api"}}
+
+	var actual TestUnmarshalModel
+	err := Unmarshal(o, map[string]interface{}{"name": "name", "secret": "secret"}, &actual)
+	assert.Equal(t, UnmarshalExcludedFieldError{Key: "secret"}, err)
+
+	err = Unmarshal(o, map[string]interface{}{
+		"children": []interface{}{map[string]interface{}{"private": "private"}},
+	}, &actual)
+	assert.Equal(t, UnmarshalExcludedFieldError{Key: "private"}, err)
+}
+
+func TestUnmarshal_InvalidType(t *testing.T) {
+	var model TestUnmarshalModel
+	err := Unmarshal(&Options{}, map[string]interface{}{}, model)
+	assert.IsType(t, UnmarshalInvalidTypeError{}, err)
+
+	err = Unmarshal(&Options{}, map[string]interface{}{}, (*TestUnmarshalModel)(nil))
+	assert.IsType(t, UnmarshalInvalidTypeError{}, err)
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+	o := &Options{Groups: []string{"api"}}
+
+	var actual TestUnmarshalModel
+	err := UnmarshalJSON(o, []byte(`{"name":"name","numbers":[9007199254740993],"child":{"public":"public"}}`), &actual)
+	assert.NoError(t, err)
+	assert.Equal(t, TestUnmarshalModel{
+		Name:    "name",
+		Numbers: []int{9007199254740993},
+		Child:   UnmarshalChild{Public: "public"},
+	}, actual)
+
+	actual = TestUnmarshalModel{}
+	err = UnmarshalJSON(o, []byte(`{"name":"name","secret":"secret"}`), &actual)
+	assert.Equal(t, UnmarshalExcludedFieldError{Key: "secret"}, err)
+	assert.Empty(t, actual.Secret)
+
+	o.Groups = []string{"api", "admin"}
+	actual = TestUnmarshalModel{}
+	err = UnmarshalJSON(o, []byte(`{"name":"name","secret":"secret"}`), &actual)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", actual.Secret)
+
+	err = UnmarshalJSON(o, []byte(`not json`), &actual)
+	assert.Error(t, err)
+}
+
+type TestUnmarshalQuotedModel struct {
+	ID      int64   `json:"id,string" groups:"api"`
+	Ratio   float64 `json:"ratio,string" groups:"api"`
+	Active  bool    `json:"active,string" groups:"api"`
+	Name    string  `json:"name,string" groups:"api"`
+	Count   *int    `json:"count,string" groups:"api"`
+	Missing *int    `json:"missing,string" groups:"api"`
+}
+
+func TestUnmarshalJSON_Quoted(t *testing.T) {
+	count := 3
+	model := TestUnmarshalQuotedModel{ID: 9007199254740993, Ratio: 0.5, Active: true, Name: "name", Count: &count}
+	o := &Options{Groups: []string{"api"}}
+
+	b, err := MarshalJSON(o, model)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id":"9007199254740993","ratio":"0.5","active":"true","name":"\"name\"","count":"3","missing":null}`, string(b))
+
+	var actual TestUnmarshalQuotedModel
+	assert.NoError(t, UnmarshalJSON(o, b, &actual))
+	assert.Equal(t, model, actual)
+
+	err = UnmarshalJSON(o, []byte(`{"id":"not a number"}`), &actual)
+	assert.Error(t, err)
+}
+
+func TestUnmarshal_Alias(t *testing.T) {
+	var actual TestAliasModel
+	err := Unmarshal(&Options{Groups: []string{"internal"}}, map[string]interface{}{"uid": "42"}, &actual)
+	assert.NoError(t, err)
+	assert.Equal(t, TestAliasModel{UserID: "42"}, actual)
+}
+
+func TestUnmarshal_Shadowing(t *testing.T) {
+	var actual TestShadowingModel
+	err := Unmarshal(&Options{FieldTag: "api"}, map[string]interface{}{"id": "id", "tagged": "tagged", "deep": "deep", "dropped": "dropped"}, &actual)
+	assert.NoError(t, err)
+	assert.Equal(t, TestShadowingModel{
+		ShadowBase: ShadowBase{Tagged: "tagged", Deep: "deep"},
+		ID:         "id",
+	}, actual)
+}